@@ -0,0 +1,312 @@
+package nds
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"golang.org/x/net/context"
+)
+
+// AuditProblem is an inconsistency between the cache and the datastore found
+// by Audit.
+type AuditProblem int
+
+const (
+	// AuditMismatch is a cached entity, or a cached missing entity, that
+	// differs from the datastore.
+	AuditMismatch AuditProblem = iota + 1
+
+	// AuditLocked is a cache lock. Locks are expected while entities are
+	// being read or written, but not for long after.
+	AuditLocked
+
+	// AuditUndecodable is a cache item that can't be decoded.
+	AuditUndecodable
+)
+
+func (p AuditProblem) String() string {
+	switch p {
+	case AuditMismatch:
+		return "mismatch"
+	case AuditLocked:
+		return "locked"
+	case AuditUndecodable:
+		return "undecodable"
+	}
+	return "unknown"
+}
+
+// AuditResult reports a problem Audit found with the cache item of an entity.
+type AuditResult struct {
+	Key     *datastore.Key
+	Problem AuditProblem
+
+	// Err is why the item couldn't be decoded, for AuditUndecodable.
+	Err error
+
+	// Repaired is set if AuditRepair replaced the item.
+	Repaired bool
+}
+
+type auditOptions struct {
+	repair bool
+}
+
+// AuditOption configures Audit.
+type AuditOption func(*auditOptions)
+
+// AuditRepair makes Audit drop the cache items of mismatched and undecodable
+// entities, so that they are loaded from the datastore and cached again. The
+// items are replaced with locks rather than deleted, so gets in progress
+// can't cache what they read before the repair.
+func AuditRepair() AuditOption {
+	return func(o *auditOptions) {
+		o.repair = true
+	}
+}
+
+// Audit calls Client.Audit on the default client.
+func Audit(c context.Context, keys []*datastore.Key,
+	opts ...AuditOption) ([]AuditResult, error) {
+	return getDefaultClient().Audit(c, keys, opts...)
+}
+
+// Audit compares the cached entities of keys with the datastore and reports
+// the cache items that are stale, locked or can't be decoded. Entities that
+// aren't cached are not reported.
+//
+// Items written while the audit runs are skipped rather than reported. Locks
+// are only reported, as they expire on their own.
+func (cl *Client) Audit(c context.Context, keys []*datastore.Key,
+	opts ...AuditOption) ([]AuditResult, error) {
+
+	o := auditOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	results := []AuditResult{}
+	for lo := 0; lo < len(keys); lo += getMultiLimit {
+		hi := lo + getMultiLimit
+		if hi > len(keys) {
+			hi = len(keys)
+		}
+		batch, err := cl.audit(c, keys[lo:hi], o)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, batch...)
+	}
+	return results, nil
+}
+
+func (cl *Client) audit(c context.Context, keys []*datastore.Key,
+	o auditOptions) ([]AuditResult, error) {
+
+	memcacheKeys := make([]string, len(keys))
+	for i, key := range keys {
+		if key == nil || key.Incomplete() {
+			return nil, datastore.ErrInvalidKey
+		}
+		memcacheKeys[i] = createMemcacheKey(key)
+	}
+
+	raw, err := cl.memcacheGetMulti(c, memcacheKeys)
+	if err != nil {
+		return nil, err
+	}
+	items := make(map[string]*Item, len(raw))
+	for key, item := range raw {
+		items[key] = item
+	}
+	cl.loadChunks(c, items)
+
+	pls := make([]datastore.PropertyList, len(keys))
+	err = cl.datastoreGetMulti(c, keys, pls)
+	me, ok := err.(datastore.MultiError)
+	if err != nil && !ok {
+		return nil, err
+	}
+	exists := make([]bool, len(keys))
+	for i := range keys {
+		if me == nil || me[i] == nil {
+			exists[i] = true
+		} else if me[i] != datastore.ErrNoSuchEntity {
+			return nil, me[i]
+		}
+	}
+
+	results := []AuditResult{}
+	suspects := []int{}
+	for i, key := range keys {
+		item, ok := items[memcacheKeys[i]]
+		if !ok {
+			continue
+		}
+		result := AuditResult{Key: key}
+		switch item.Flags {
+		case lockItem:
+			result.Problem = AuditLocked
+		case noneItem:
+			if exists[i] {
+				result.Problem = AuditMismatch
+			}
+		case entityItem:
+			pl := datastore.PropertyList{}
+			if err := cl.unmarshal(item.Value, &pl); err != nil {
+				result.Problem, result.Err = AuditUndecodable, err
+			} else if !exists[i] || !propertyListsEqual(pl, pls[i]) {
+				result.Problem = AuditMismatch
+			}
+		case chunkedItem:
+			// Chunks are missing, so the entity will be loaded again.
+		default:
+			result.Problem = AuditUndecodable
+		}
+		if result.Problem == AuditLocked {
+			results = append(results, result)
+		} else if result.Problem != 0 {
+			suspects = append(suspects, i)
+			results = append(results, result)
+		}
+	}
+	if len(suspects) == 0 {
+		return results, nil
+	}
+
+	// Items that changed since they were first read were written while the
+	// datastore was read, so they may be right.
+	suspectKeys := make([]string, len(suspects))
+	for j, i := range suspects {
+		suspectKeys[j] = memcacheKeys[i]
+	}
+	again, err := cl.memcacheGetMulti(c, suspectKeys)
+	if err != nil {
+		return nil, err
+	}
+	confirmed := results[:0]
+	locks := []*Item{}
+	lockResults := []int{}
+	j := 0
+	for _, result := range results {
+		if result.Problem == AuditLocked {
+			confirmed = append(confirmed, result)
+			continue
+		}
+		memcacheKey := suspectKeys[j]
+		j++
+		item, ok := again[memcacheKey]
+		if !ok || !sameItem(item, raw[memcacheKey]) {
+			continue
+		}
+		if o.repair {
+			lock := &Item{
+				Key:        memcacheKey,
+				Flags:      lockItem,
+				Value:      itemLock(),
+				Expiration: memcacheLockTime,
+			}
+			lock.SetCASInfo(item.CASInfo())
+			locks = append(locks, lock)
+			lockResults = append(lockResults, len(confirmed))
+		}
+		confirmed = append(confirmed, result)
+	}
+
+	if len(locks) > 0 {
+		cl.repairItems(c, locks, lockResults, confirmed)
+	}
+	return confirmed, nil
+}
+
+// repairItems swaps the cache items of confirmed results for locks. Items
+// that changed since they were checked are left alone.
+func (cl *Client) repairItems(c context.Context, locks []*Item,
+	lockResults []int, results []AuditResult) {
+
+	keys := make([]string, len(locks))
+	for i, lock := range locks {
+		keys[i] = lock.Key
+	}
+	cl.localCache.delete(keys)
+
+	err := cl.memcacheCompareAndSwapMulti(c, locks)
+	me, ok := err.(datastore.MultiError)
+	ok = ok && len(me) == len(locks)
+	if err != nil && !ok {
+		cl.warn(c, "audit", "cache CompareAndSwapMulti failed", err,
+			"keys", len(locks))
+		return
+	}
+	for i, r := range lockResults {
+		results[r].Repaired = err == nil || me[i] == nil
+	}
+}
+
+// sameItem reports whether two reads of a cache item got the same item. A
+// rewritten item with the same value is as good as the same item.
+func sameItem(a, b *Item) bool {
+	return a.Flags == b.Flags && bytes.Equal(a.Value, b.Value)
+}
+
+// propertyListsEqual reports whether two property lists hold the same
+// properties, in any order.
+func propertyListsEqual(a, b datastore.PropertyList) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a, b = sortedProperties(a), sortedProperties(b)
+	for i := range a {
+		if a[i].Name != b[i].Name || a[i].NoIndex != b[i].NoIndex ||
+			!propertyValuesEqual(a[i].Value, b[i].Value) {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedProperties(pl datastore.PropertyList) datastore.PropertyList {
+	sorted := append(datastore.PropertyList(nil), pl...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted
+}
+
+// propertyValuesEqual compares property values the way the datastore does,
+// ignoring differences that encoding introduces, such as time zones.
+func propertyValuesEqual(a, b interface{}) bool {
+	switch a := a.(type) {
+	case time.Time:
+		b, ok := b.(time.Time)
+		return ok && a.Equal(b)
+	case *datastore.Key:
+		b, ok := b.(*datastore.Key)
+		return ok && a.Equal(b)
+	case []byte:
+		b, ok := b.([]byte)
+		return ok && bytes.Equal(a, b)
+	case *datastore.Entity:
+		b, ok := b.(*datastore.Entity)
+		if !ok || a == nil || b == nil {
+			return ok && a == b
+		}
+		return a.Key.Equal(b.Key) &&
+			propertyListsEqual(a.Properties, b.Properties)
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !propertyValuesEqual(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,100 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/yoavfeld/nds"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestClientAudit(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	cache := newMemoryCache()
+	cl, err := nds.NewClient(nds.DsClient(), nds.WithCache(cache))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []*datastore.Key{
+		datastore.IDKey("AuditEntity", 1, nil),
+		datastore.IDKey("AuditEntity", 2, nil),
+		datastore.IDKey("AuditEntity", 3, nil),
+		datastore.IDKey("AuditEntity", 4, nil),
+	}
+	if _, err := cl.PutMulti(c, keys[:3],
+		[]testEntity{{1}, {1}, {1}}); err != nil {
+		t.Fatal(err)
+	}
+	err = cl.GetMulti(c, keys, make([]testEntity, len(keys)))
+	if me, ok := err.(datastore.MultiError); !ok ||
+		me[3] != datastore.ErrNoSuchEntity {
+		t.Fatal("expected ErrNoSuchEntity", err)
+	}
+
+	// A consistent cache has nothing to report.
+	results, err := cl.Audit(c, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 0 {
+		t.Fatal("expected no problems", results)
+	}
+
+	// Write behind nds' back and corrupt an item.
+	if _, err := nds.DsClient().Put(c, keys[0], &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nds.DsClient().Put(c, keys[3], &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.SetMulti(c, []*nds.Item{{
+		Key:   nds.CreateMemcacheKey(keys[1]),
+		Flags: nds.EntityItem,
+		Value: []byte("garbage"),
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err = cl.Audit(c, keys, nds.AuditRepair())
+	if err != nil {
+		t.Fatal(err)
+	}
+	problems := map[int64]nds.AuditProblem{}
+	for _, result := range results {
+		if !result.Repaired {
+			t.Fatal("expected the item to be repaired", result.Key)
+		}
+		problems[result.Key.ID] = result.Problem
+	}
+	if len(problems) != 3 || problems[1] != nds.AuditMismatch ||
+		problems[2] != nds.AuditUndecodable ||
+		problems[4] != nds.AuditMismatch {
+		t.Fatal("unexpected problems", problems)
+	}
+
+	// The repaired items are locked and the entities read from the
+	// datastore.
+	results, err = cl.Audit(c, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, result := range results {
+		if result.Problem != nds.AuditLocked {
+			t.Fatal("expected a lock", result.Key, result.Problem)
+		}
+	}
+	entities := make([]testEntity, len(keys))
+	if err := cl.GetMulti(c, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+	if entities[0].Val != 2 || entities[3].Val != 2 {
+		t.Fatal("expected the written entities", entities)
+	}
+}
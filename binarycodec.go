@@ -0,0 +1,345 @@
+package nds
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Value type tags used by BinaryCodec.
+const (
+	binaryNil byte = iota
+	binaryInt64
+	binaryBool
+	binaryString
+	binaryFloat64
+	binaryKey
+	binaryTime
+	binaryBytes
+	binaryGeoPoint
+	binaryEntity
+	binaryArray
+)
+
+// binaryVersion is the first byte of every BinaryCodec payload. It keeps the
+// payloads clear of the compression headers.
+const binaryVersion byte = 1
+
+// binaryMaxDepth bounds the nesting of entities, arrays and key parents that
+// BinaryCodec will decode.
+const binaryMaxDepth = 100
+
+var errBinaryTruncated = errors.New("nds: truncated binary property list")
+
+// BinaryCodec is a compact Codec that encodes every datastore property type,
+// including nested entities, keys, GeoPoints and []interface{} values. The
+// same property list always encodes to the same bytes.
+type BinaryCodec struct{}
+
+// Marshal implements Codec.
+func (BinaryCodec) Marshal(pl datastore.PropertyList) ([]byte, error) {
+	return appendBinaryProperties([]byte{binaryVersion}, pl)
+}
+
+// Unmarshal implements Codec.
+func (BinaryCodec) Unmarshal(data []byte, pl *datastore.PropertyList) error {
+	if len(data) == 0 || data[0] != binaryVersion {
+		return errors.New("nds: unknown binary property list version")
+	}
+	d := &binaryDecoder{data: data[1:]}
+	props, err := d.properties(0)
+	if err != nil {
+		return err
+	}
+	if len(d.data) != 0 {
+		return errors.New("nds: trailing data after binary property list")
+	}
+	*pl = props
+	return nil
+}
+
+func appendBinaryProperties(b []byte,
+	props []datastore.Property) ([]byte, error) {
+
+	b = binary.AppendUvarint(b, uint64(len(props)))
+	for _, p := range props {
+		b = appendBinaryString(b, p.Name)
+		if p.NoIndex {
+			b = append(b, 1)
+		} else {
+			b = append(b, 0)
+		}
+		var err error
+		if b, err = appendBinaryValue(b, p.Value); err != nil {
+			return nil, fmt.Errorf("nds: property %q: %s", p.Name, err)
+		}
+	}
+	return b, nil
+}
+
+func appendBinaryValue(b []byte, v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(b, binaryNil), nil
+	case int64:
+		return binary.AppendVarint(append(b, binaryInt64), v), nil
+	case bool:
+		if v {
+			return append(b, binaryBool, 1), nil
+		}
+		return append(b, binaryBool, 0), nil
+	case string:
+		return appendBinaryString(append(b, binaryString), v), nil
+	case float64:
+		return binary.LittleEndian.AppendUint64(append(b, binaryFloat64),
+			math.Float64bits(v)), nil
+	case *datastore.Key:
+		return appendBinaryKey(append(b, binaryKey), v), nil
+	case time.Time:
+		b = binary.AppendVarint(append(b, binaryTime), v.Unix())
+		return binary.AppendUvarint(b, uint64(v.Nanosecond())), nil
+	case []byte:
+		b = binary.AppendUvarint(append(b, binaryBytes), uint64(len(v)))
+		return append(b, v...), nil
+	case datastore.GeoPoint:
+		b = binary.LittleEndian.AppendUint64(append(b, binaryGeoPoint),
+			math.Float64bits(v.Lat))
+		return binary.LittleEndian.AppendUint64(b, math.Float64bits(v.Lng)), nil
+	case *datastore.Entity:
+		b = append(b, binaryEntity)
+		if v == nil {
+			return append(b, 0), nil
+		}
+		b = appendBinaryKey(append(b, 1), v.Key)
+		return appendBinaryProperties(b, v.Properties)
+	case []interface{}:
+		b = binary.AppendUvarint(append(b, binaryArray), uint64(len(v)))
+		for _, elem := range v {
+			var err error
+			if b, err = appendBinaryValue(b, elem); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("unsupported type %T", v)
+	}
+}
+
+// appendBinaryKey encodes key, which may be nil, followed by its parents.
+func appendBinaryKey(b []byte, key *datastore.Key) []byte {
+	if key == nil {
+		return append(b, 0)
+	}
+	b = append(b, 1)
+	b = appendBinaryString(b, key.Kind)
+	b = binary.AppendVarint(b, key.ID)
+	b = appendBinaryString(b, key.Name)
+	b = appendBinaryString(b, key.Namespace)
+	return appendBinaryKey(b, key.Parent)
+}
+
+func appendBinaryString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+type binaryDecoder struct {
+	data []byte
+}
+
+func (d *binaryDecoder) properties(depth int) ([]datastore.Property, error) {
+	if depth > binaryMaxDepth {
+		return nil, errors.New("nds: binary property list nested too deeply")
+	}
+	n, err := d.length()
+	if err != nil {
+		return nil, err
+	}
+	props := make([]datastore.Property, n)
+	for i := range props {
+		if props[i].Name, err = d.string(); err != nil {
+			return nil, err
+		}
+		noIndex, err := d.byte()
+		if err != nil {
+			return nil, err
+		}
+		props[i].NoIndex = noIndex == 1
+		if props[i].Value, err = d.value(depth); err != nil {
+			return nil, err
+		}
+	}
+	return props, nil
+}
+
+func (d *binaryDecoder) value(depth int) (interface{}, error) {
+	tag, err := d.byte()
+	if err != nil {
+		return nil, err
+	}
+	switch tag {
+	case binaryNil:
+		return nil, nil
+	case binaryInt64:
+		return d.varint()
+	case binaryBool:
+		v, err := d.byte()
+		return v == 1, err
+	case binaryString:
+		return d.string()
+	case binaryFloat64:
+		return d.float64()
+	case binaryKey:
+		return d.key(depth)
+	case binaryTime:
+		sec, err := d.varint()
+		if err != nil {
+			return nil, err
+		}
+		nsec, err := d.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		return time.Unix(sec, int64(nsec)), nil
+	case binaryBytes:
+		n, err := d.length()
+		if err != nil {
+			return nil, err
+		}
+		v := make([]byte, n)
+		copy(v, d.data)
+		d.data = d.data[n:]
+		return v, nil
+	case binaryGeoPoint:
+		lat, err := d.float64()
+		if err != nil {
+			return nil, err
+		}
+		lng, err := d.float64()
+		if err != nil {
+			return nil, err
+		}
+		return datastore.GeoPoint{Lat: lat, Lng: lng}, nil
+	case binaryEntity:
+		present, err := d.byte()
+		if err != nil || present == 0 {
+			return (*datastore.Entity)(nil), err
+		}
+		e := &datastore.Entity{}
+		if e.Key, err = d.key(depth + 1); err != nil {
+			return nil, err
+		}
+		if e.Properties, err = d.properties(depth + 1); err != nil {
+			return nil, err
+		}
+		return e, nil
+	case binaryArray:
+		if depth > binaryMaxDepth {
+			return nil, errors.New("nds: binary property list nested too deeply")
+		}
+		n, err := d.length()
+		if err != nil {
+			return nil, err
+		}
+		v := make([]interface{}, n)
+		for i := range v {
+			if v[i], err = d.value(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		return v, nil
+	default:
+		return nil, fmt.Errorf("nds: unknown binary value type %d", tag)
+	}
+}
+
+func (d *binaryDecoder) key(depth int) (*datastore.Key, error) {
+	if depth > binaryMaxDepth {
+		return nil, errors.New("nds: binary key nested too deeply")
+	}
+	present, err := d.byte()
+	if err != nil || present == 0 {
+		return nil, err
+	}
+	key := &datastore.Key{}
+	if key.Kind, err = d.string(); err != nil {
+		return nil, err
+	}
+	if key.ID, err = d.varint(); err != nil {
+		return nil, err
+	}
+	if key.Name, err = d.string(); err != nil {
+		return nil, err
+	}
+	if key.Namespace, err = d.string(); err != nil {
+		return nil, err
+	}
+	if key.Parent, err = d.key(depth + 1); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (d *binaryDecoder) byte() (byte, error) {
+	if len(d.data) < 1 {
+		return 0, errBinaryTruncated
+	}
+	b := d.data[0]
+	d.data = d.data[1:]
+	return b, nil
+}
+
+func (d *binaryDecoder) varint() (int64, error) {
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		return 0, errBinaryTruncated
+	}
+	d.data = d.data[n:]
+	return v, nil
+}
+
+func (d *binaryDecoder) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		return 0, errBinaryTruncated
+	}
+	d.data = d.data[n:]
+	return v, nil
+}
+
+// length reads a length prefix and checks that at least that many bytes
+// remain, which also bounds allocations made from corrupt data.
+func (d *binaryDecoder) length() (int, error) {
+	n, err := d.uvarint()
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(len(d.data)) {
+		return 0, errBinaryTruncated
+	}
+	return int(n), nil
+}
+
+func (d *binaryDecoder) string() (string, error) {
+	n, err := d.length()
+	if err != nil {
+		return "", err
+	}
+	s := string(d.data[:n])
+	d.data = d.data[n:]
+	return s, nil
+}
+
+func (d *binaryDecoder) float64() (float64, error) {
+	if len(d.data) < 8 {
+		return 0, errBinaryTruncated
+	}
+	v := math.Float64frombits(binary.LittleEndian.Uint64(d.data))
+	d.data = d.data[8:]
+	return v, nil
+}
@@ -0,0 +1,214 @@
+package nds
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"golang.org/x/net/context"
+)
+
+// circuitBreakerMinCalls is the number of cache calls a window needs before
+// its error rate can open the circuit.
+const circuitBreakerMinCalls = 20
+
+// errCircuitOpen is returned by cache calls made while the circuit is open.
+var errCircuitOpen = errors.New("nds: cache circuit breaker is open")
+
+// WithCircuitBreaker stops the Client from calling the cache once at least
+// errorRate of its cache calls within window have failed. While the circuit
+// is open gets go straight to the datastore without caching, and puts and
+// deletes fail as they would with any cache failure unless WithDegradedWrites
+// is used. After openTime one call is let through to try the cache again,
+// and the circuit closes if it succeeds.
+//
+// Per item failures, such as a lost compare and swap, and calls cut short by
+// the caller's context don't count as failed calls.
+func WithCircuitBreaker(errorRate float64,
+	window, openTime time.Duration) ClientOption {
+	return func(cl *Client) {
+		cl.breaker = &circuitBreaker{
+			errorRate: errorRate,
+			window:    window,
+			openTime:  openTime,
+		}
+	}
+}
+
+type circuitState int
+
+const (
+	closedCircuit circuitState = iota
+	openCircuit
+
+	// halfOpenCircuit is an open circuit with a trial call in flight.
+	halfOpenCircuit
+)
+
+// circuitBreaker counts failed cache calls and opens the circuit when there
+// are too many. A nil *circuitBreaker never opens.
+type circuitBreaker struct {
+	errorRate float64
+	window    time.Duration
+	openTime  time.Duration
+
+	mu          sync.Mutex
+	state       circuitState
+	windowStart time.Time
+	calls       int
+	failures    int
+	openedAt    time.Time
+}
+
+// isOpen reports whether cache calls are being rejected.
+func (cb *circuitBreaker) isOpen() bool {
+	if cb == nil {
+		return false
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state == halfOpenCircuit ||
+		cb.state == openCircuit && time.Since(cb.openedAt) < cb.openTime
+}
+
+// allow reports whether a cache call may be made. Once the circuit has been
+// open for openTime the next call is allowed as a trial.
+func (cb *circuitBreaker) allow() bool {
+	if cb == nil {
+		return true
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state {
+	case closedCircuit:
+		return true
+	case openCircuit:
+		if time.Since(cb.openedAt) < cb.openTime {
+			return false
+		}
+		cb.state = halfOpenCircuit
+		return true
+	default:
+		return false
+	}
+}
+
+// record counts the outcome of an allowed call. It reports whether the call
+// opened or closed the circuit.
+func (cb *circuitBreaker) record(failed bool) (state circuitState,
+	changed bool) {
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	now := time.Now()
+	switch cb.state {
+	case halfOpenCircuit:
+		if failed {
+			cb.state = openCircuit
+			cb.openedAt = now
+			return cb.state, false
+		}
+		cb.state = closedCircuit
+		cb.windowStart, cb.calls, cb.failures = now, 0, 0
+		return cb.state, true
+	case closedCircuit:
+		if now.Sub(cb.windowStart) >= cb.window {
+			cb.windowStart, cb.calls, cb.failures = now, 0, 0
+		}
+		cb.calls++
+		if failed {
+			cb.failures++
+		}
+		if cb.calls >= circuitBreakerMinCalls &&
+			float64(cb.failures) >= cb.errorRate*float64(cb.calls) {
+			cb.state = openCircuit
+			cb.openedAt = now
+			return cb.state, true
+		}
+	}
+	return cb.state, false
+}
+
+// abandon gives up on an allowed call whose outcome says nothing about the
+// cache. A trial call is retried by the next call.
+func (cb *circuitBreaker) abandon() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state == halfOpenCircuit {
+		cb.state = openCircuit
+	}
+}
+
+// breakerCache is a Cache that rejects calls while the circuit of its
+// Client's breaker is open.
+type breakerCache struct {
+	Cache
+	cl *Client
+}
+
+// call makes op, a call for a batch of n items, unless the circuit is open.
+// Empty batches don't need the cache, so they succeed without a call whatever
+// the state of the circuit.
+func (bc *breakerCache) call(c context.Context, n int, op func() error) error {
+	if n == 0 {
+		return nil
+	}
+	breaker := bc.cl.breaker
+	if !breaker.allow() {
+		return errCircuitOpen
+	}
+
+	err := op()
+	if c.Err() != nil {
+		breaker.abandon()
+		return err
+	}
+	_, perItem := err.(datastore.MultiError)
+	if state, changed := breaker.record(err != nil && !perItem); changed {
+		if state == openCircuit {
+			bc.cl.warn(c, "circuitBreaker", "cache circuit breaker opened",
+				err)
+		} else {
+			bc.cl.debug(c, "circuitBreaker", "cache circuit breaker closed",
+				nil)
+		}
+	}
+	return err
+}
+
+func (bc *breakerCache) AddMulti(c context.Context, items []*Item) error {
+	return bc.call(c, len(items), func() error {
+		return bc.Cache.AddMulti(c, items)
+	})
+}
+
+func (bc *breakerCache) CompareAndSwapMulti(c context.Context,
+	items []*Item) error {
+	return bc.call(c, len(items), func() error {
+		return bc.Cache.CompareAndSwapMulti(c, items)
+	})
+}
+
+func (bc *breakerCache) DeleteMulti(c context.Context, keys []string) error {
+	return bc.call(c, len(keys), func() error {
+		return bc.Cache.DeleteMulti(c, keys)
+	})
+}
+
+func (bc *breakerCache) GetMulti(c context.Context,
+	keys []string) (map[string]*Item, error) {
+	var items map[string]*Item
+	err := bc.call(c, len(keys), func() error {
+		var err error
+		items, err = bc.Cache.GetMulti(c, keys)
+		return err
+	})
+	return items, err
+}
+
+func (bc *breakerCache) SetMulti(c context.Context, items []*Item) error {
+	return bc.call(c, len(items), func() error {
+		return bc.Cache.SetMulti(c, items)
+	})
+}
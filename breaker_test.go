@@ -0,0 +1,158 @@
+package nds_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yoavfeld/nds"
+
+	"cloud.google.com/go/datastore"
+	"golang.org/x/net/context"
+)
+
+var errCacheDown = errors.New("cache down")
+
+// failingCache is a memoryCache that counts calls and fails them all while
+// down is set.
+type failingCache struct {
+	*memoryCache
+
+	mu    sync.Mutex
+	down  bool
+	calls int
+}
+
+func (fc *failingCache) setDown(down bool) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.down = down
+}
+
+func (fc *failingCache) callCount() int {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.calls
+}
+
+func (fc *failingCache) call() error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.calls++
+	if fc.down {
+		return errCacheDown
+	}
+	return nil
+}
+
+func (fc *failingCache) AddMulti(c context.Context, items []*nds.Item) error {
+	if err := fc.call(); err != nil {
+		return err
+	}
+	return fc.memoryCache.AddMulti(c, items)
+}
+
+func (fc *failingCache) CompareAndSwapMulti(c context.Context,
+	items []*nds.Item) error {
+	if err := fc.call(); err != nil {
+		return err
+	}
+	return fc.memoryCache.CompareAndSwapMulti(c, items)
+}
+
+func (fc *failingCache) DeleteMulti(c context.Context, keys []string) error {
+	if err := fc.call(); err != nil {
+		return err
+	}
+	return fc.memoryCache.DeleteMulti(c, keys)
+}
+
+func (fc *failingCache) GetMulti(c context.Context,
+	keys []string) (map[string]*nds.Item, error) {
+	if err := fc.call(); err != nil {
+		return nil, err
+	}
+	return fc.memoryCache.GetMulti(c, keys)
+}
+
+func (fc *failingCache) SetMulti(c context.Context, items []*nds.Item) error {
+	if err := fc.call(); err != nil {
+		return err
+	}
+	return fc.memoryCache.SetMulti(c, items)
+}
+
+func TestClientWithCircuitBreaker(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	if _, err := nds.NewClient(nds.DsClient(), nds.WithCache(newMemoryCache()),
+		nds.WithCircuitBreaker(0, time.Minute, time.Second)); err == nil {
+		t.Fatal("expected invalid circuit breaker error")
+	}
+
+	cache := &failingCache{memoryCache: newMemoryCache()}
+	const openTime = 100 * time.Millisecond
+	cl, err := nds.NewClient(nds.DsClient(), nds.WithCache(cache),
+		nds.WithCircuitBreaker(0.5, time.Minute, openTime))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := datastore.IDKey("BreakerEntity", 1, nil)
+	if _, err := cl.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Gets keep working from the datastore while the failures open the
+	// circuit.
+	cache.setDown(true)
+	for i := 0; i < 20; i++ {
+		entity := &testEntity{}
+		if err := cl.Get(c, key, entity); err != nil {
+			t.Fatal(err)
+		}
+		if entity.Val != 1 {
+			t.Fatal("incorrect val", entity.Val)
+		}
+	}
+
+	// The open circuit keeps gets away from the cache and puts fail closed.
+	calls := cache.callCount()
+	if err := cl.Get(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cl.Put(c, key, &testEntity{2}); err == nil {
+		t.Fatal("expected put to fail while the circuit is open")
+	}
+
+	// Puts that need no lock still work.
+	if _, err := cl.Put(c, datastore.IncompleteKey("BreakerEntity", nil),
+		&testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+	if got := cache.callCount(); got != calls {
+		t.Fatal("expected no cache calls while the circuit is open",
+			got-calls)
+	}
+
+	// A trial call closes the circuit once the cache is back.
+	cache.setDown(false)
+	time.Sleep(openTime)
+	for i := 0; i < 2; i++ {
+		if err := cl.Get(c, key, &testEntity{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := cache.callCount(); got == calls {
+		t.Fatal("expected the cache to be used again")
+	}
+	if _, err := cl.Put(c, key, &testEntity{3}); err != nil {
+		t.Fatal(err)
+	}
+}
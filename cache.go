@@ -0,0 +1,162 @@
+package nds
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Cache is the backend nds uses to cache entities. It only needs to provide
+// the primitives that the nds locking protocol is built upon. A memcache
+// implementation is created with NewMemcache or WithMemcacheClient, and other
+// stores can be used by passing their implementation to WithCache.
+//
+// The multi methods that take items or keys must return nil if every item
+// succeeded, otherwise a datastore.MultiError with one entry per item in the
+// same order, or a single error if the whole call failed.
+//
+// Methods should return c.Err() as soon as c is done. nds treats that like
+// any other failed cache call.
+type Cache interface {
+	// AddMulti writes each item only if its key does not already exist in
+	// the cache.
+	AddMulti(c context.Context, items []*Item) error
+
+	// CompareAndSwapMulti writes each item only if it has not been modified
+	// since it was returned by GetMulti. Items that were not returned by
+	// GetMulti must fail.
+	CompareAndSwapMulti(c context.Context, items []*Item) error
+
+	// DeleteMulti removes each key from the cache.
+	DeleteMulti(c context.Context, keys []string) error
+
+	// GetMulti returns the items found for keys. Keys that are not in the
+	// cache are left out of the map rather than reported as errors.
+	GetMulti(c context.Context, keys []string) (map[string]*Item, error)
+
+	// SetMulti writes each item unconditionally.
+	SetMulti(c context.Context, items []*Item) error
+}
+
+// Item is the unit stored in a Cache.
+type Item struct {
+	// Key is the cache key of the item.
+	Key string
+
+	// Value is the item's payload.
+	Value []byte
+
+	// Flags tells nds how to interpret Value. Cache implementations must
+	// store and return it unchanged.
+	Flags uint32
+
+	// Expiration is how long the item should stay in the cache. Zero means
+	// the item does not expire.
+	Expiration time.Duration
+
+	// casInfo is opaque Cache implementation state that lets
+	// CompareAndSwapMulti detect if the item changed since GetMulti.
+	casInfo interface{}
+}
+
+// SetCASInfo stores Cache implementation specific compare and swap state on
+// the item. It is intended to be called by GetMulti implementations.
+func (i *Item) SetCASInfo(value interface{}) {
+	i.casInfo = value
+}
+
+// CASInfo returns the value stored by SetCASInfo.
+func (i *Item) CASInfo() interface{} {
+	return i.casInfo
+}
+
+// WithCacheTimeout bounds each call to the cache to timeout, on top of any
+// deadline the caller's context has. A cache call that runs out of time
+// counts as failed, so entities are read from the datastore instead.
+func WithCacheTimeout(timeout time.Duration) ClientOption {
+	return func(cl *Client) {
+		cl.cacheTimeout = timeout
+	}
+}
+
+// nonEmptyCache is a Cache that doesn't call the Cache it wraps for empty
+// batches, so that calls which need no cache items don't need the cache.
+type nonEmptyCache struct {
+	Cache
+}
+
+func (nc *nonEmptyCache) AddMulti(c context.Context, items []*Item) error {
+	if len(items) == 0 {
+		return nil
+	}
+	return nc.Cache.AddMulti(c, items)
+}
+
+func (nc *nonEmptyCache) CompareAndSwapMulti(c context.Context,
+	items []*Item) error {
+	if len(items) == 0 {
+		return nil
+	}
+	return nc.Cache.CompareAndSwapMulti(c, items)
+}
+
+func (nc *nonEmptyCache) DeleteMulti(c context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return nc.Cache.DeleteMulti(c, keys)
+}
+
+func (nc *nonEmptyCache) GetMulti(c context.Context,
+	keys []string) (map[string]*Item, error) {
+	if len(keys) == 0 {
+		return map[string]*Item{}, nil
+	}
+	return nc.Cache.GetMulti(c, keys)
+}
+
+func (nc *nonEmptyCache) SetMulti(c context.Context, items []*Item) error {
+	if len(items) == 0 {
+		return nil
+	}
+	return nc.Cache.SetMulti(c, items)
+}
+
+// timeoutCache is a Cache that gives each call of the Cache it wraps its own
+// deadline.
+type timeoutCache struct {
+	Cache
+	timeout time.Duration
+}
+
+func (tc *timeoutCache) AddMulti(c context.Context, items []*Item) error {
+	c, cancel := context.WithTimeout(c, tc.timeout)
+	defer cancel()
+	return tc.Cache.AddMulti(c, items)
+}
+
+func (tc *timeoutCache) CompareAndSwapMulti(c context.Context,
+	items []*Item) error {
+	c, cancel := context.WithTimeout(c, tc.timeout)
+	defer cancel()
+	return tc.Cache.CompareAndSwapMulti(c, items)
+}
+
+func (tc *timeoutCache) DeleteMulti(c context.Context, keys []string) error {
+	c, cancel := context.WithTimeout(c, tc.timeout)
+	defer cancel()
+	return tc.Cache.DeleteMulti(c, keys)
+}
+
+func (tc *timeoutCache) GetMulti(c context.Context,
+	keys []string) (map[string]*Item, error) {
+	c, cancel := context.WithTimeout(c, tc.timeout)
+	defer cancel()
+	return tc.Cache.GetMulti(c, keys)
+}
+
+func (tc *timeoutCache) SetMulti(c context.Context, items []*Item) error {
+	c, cancel := context.WithTimeout(c, tc.timeout)
+	defer cancel()
+	return tc.Cache.SetMulti(c, items)
+}
@@ -0,0 +1,173 @@
+package nds_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/yoavfeld/nds"
+
+	"cloud.google.com/go/datastore"
+	"golang.org/x/net/context"
+)
+
+var (
+	errNotStored   = errors.New("not stored")
+	errCASConflict = errors.New("cas conflict")
+	errCacheMiss   = errors.New("cache miss")
+)
+
+// memoryCache is a minimal nds.Cache used to test that nds works with
+// backends other than memcache.
+type memoryCache struct {
+	sync.Mutex
+	items    map[string]nds.Item
+	versions map[string]uint64
+}
+
+func newMemoryCache() *memoryCache {
+	return &memoryCache{
+		items:    map[string]nds.Item{},
+		versions: map[string]uint64{},
+	}
+}
+
+func (m *memoryCache) store(item *nds.Item) {
+	m.items[item.Key] = nds.Item{
+		Key:        item.Key,
+		Value:      append([]byte(nil), item.Value...),
+		Flags:      item.Flags,
+		Expiration: item.Expiration,
+	}
+	m.versions[item.Key]++
+}
+
+func (m *memoryCache) AddMulti(c context.Context, items []*nds.Item) error {
+	m.Lock()
+	defer m.Unlock()
+	me, any := make(datastore.MultiError, len(items)), false
+	for i, item := range items {
+		if _, ok := m.items[item.Key]; ok {
+			me[i], any = errNotStored, true
+			continue
+		}
+		m.store(item)
+	}
+	if any {
+		return me
+	}
+	return nil
+}
+
+func (m *memoryCache) CompareAndSwapMulti(c context.Context,
+	items []*nds.Item) error {
+	m.Lock()
+	defer m.Unlock()
+	me, any := make(datastore.MultiError, len(items)), false
+	for i, item := range items {
+		version, ok := item.CASInfo().(uint64)
+		if _, exists := m.items[item.Key]; !ok || !exists ||
+			version != m.versions[item.Key] {
+			me[i], any = errCASConflict, true
+			continue
+		}
+		m.store(item)
+	}
+	if any {
+		return me
+	}
+	return nil
+}
+
+func (m *memoryCache) DeleteMulti(c context.Context, keys []string) error {
+	m.Lock()
+	defer m.Unlock()
+	me, any := make(datastore.MultiError, len(keys)), false
+	for i, key := range keys {
+		if _, ok := m.items[key]; !ok {
+			me[i], any = errCacheMiss, true
+			continue
+		}
+		delete(m.items, key)
+	}
+	if any {
+		return me
+	}
+	return nil
+}
+
+func (m *memoryCache) GetMulti(c context.Context,
+	keys []string) (map[string]*nds.Item, error) {
+	m.Lock()
+	defer m.Unlock()
+	items := map[string]*nds.Item{}
+	for _, key := range keys {
+		if item, ok := m.items[key]; ok {
+			item.Value = append([]byte(nil), item.Value...)
+			item.SetCASInfo(m.versions[key])
+			items[key] = &item
+		}
+	}
+	return items, nil
+}
+
+func (m *memoryCache) SetMulti(c context.Context, items []*nds.Item) error {
+	m.Lock()
+	defer m.Unlock()
+	for _, item := range items {
+		m.store(item)
+	}
+	return nil
+}
+
+func TestClientWithCache(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	cache := newMemoryCache()
+	cl, err := nds.NewClient(nds.DsClient(), nds.WithCache(cache))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := datastore.IDKey("Entity", 1, nil)
+	if _, err := cl.Put(c, key, &testEntity{42}); err != nil {
+		t.Fatal(err)
+	}
+
+	te := &testEntity{}
+	if err := cl.Get(c, key, te); err != nil {
+		t.Fatal(err)
+	}
+	if te.IntVal != 42 {
+		t.Fatal("te.IntVal != 42", te.IntVal)
+	}
+
+	memcacheKey := nds.CreateMemcacheKey(key)
+	items, _ := cache.GetMulti(c, []string{memcacheKey})
+	if item, ok := items[memcacheKey]; !ok {
+		t.Fatal("expected item in cache")
+	} else if item.Flags != nds.EntityItem {
+		t.Fatal("expected entity item", item.Flags)
+	}
+
+	// Get from cache.
+	te = &testEntity{}
+	if err := cl.Get(c, key, te); err != nil {
+		t.Fatal(err)
+	}
+	if te.IntVal != 42 {
+		t.Fatal("te.IntVal != 42", te.IntVal)
+	}
+
+	if err := cl.Delete(c, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Get(c, key, &testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity")
+	}
+}
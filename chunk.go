@@ -0,0 +1,226 @@
+package nds
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// defaultMaxItemSize is the largest value stored in a single cache item. It is
+// memcache's 1MB item limit less room for the key and item overhead.
+const defaultMaxItemSize = 1<<20 - 1024
+
+// maxChunkedExpiration is the longest a chunked entity stays cached. Writes
+// replace manifests with locks without reading them, so the chunks of a
+// replaced manifest are only removed when they expire.
+const maxChunkedExpiration = 24 * time.Hour
+
+// WithMaxItemSize sets the largest value the Client stores in a single cache
+// item. Entities that encode to more than size bytes are split across several
+// chunk items, and a manifest item listing them takes part in the locking
+// protocol in place of the entity item.
+func WithMaxItemSize(size int) ClientOption {
+	return func(cl *Client) {
+		cl.maxItemSize = size
+	}
+}
+
+// chunkManifest describes the chunks an entity payload was split into.
+// Every save draws a new nonce so the chunks of different saves never share
+// keys.
+type chunkManifest struct {
+	nonce    []byte
+	count    int
+	size     int
+	checksum uint32
+}
+
+// splitChunks splits data into chunk items of at most size bytes and returns
+// them with the manifest value that refers to them.
+func splitChunks(memcacheKey string, data []byte,
+	size int) ([]byte, []*Item) {
+
+	m := chunkManifest{
+		nonce:    newGeneration(),
+		count:    (len(data) + size - 1) / size,
+		size:     len(data),
+		checksum: crc32.ChecksumIEEE(data),
+	}
+
+	chunks := make([]*Item, m.count)
+	for i := range chunks {
+		hi := (i + 1) * size
+		if hi > len(data) {
+			hi = len(data)
+		}
+		chunks[i] = &Item{
+			Key:   createChunkMemcacheKey(memcacheKey, m.nonce, i),
+			Flags: chunkItem,
+			Value: data[i*size : hi],
+		}
+	}
+	return m.encode(), chunks
+}
+
+// chunkedExpiration returns the expiration of the manifest and chunks of an
+// entity whose items would otherwise expire after ttl.
+func chunkedExpiration(ttl time.Duration) time.Duration {
+	if ttl <= 0 || ttl > maxChunkedExpiration {
+		return maxChunkedExpiration
+	}
+	return ttl
+}
+
+func (m chunkManifest) encode() []byte {
+	b := append([]byte(nil), m.nonce...)
+	b = binary.AppendUvarint(b, uint64(m.count))
+	b = binary.AppendUvarint(b, uint64(m.size))
+	return binary.LittleEndian.AppendUint32(b, m.checksum)
+}
+
+func decodeChunkManifest(data []byte) (chunkManifest, error) {
+	errMalformed := errors.New("nds: malformed chunk manifest")
+	if len(data) < 8 {
+		return chunkManifest{}, errMalformed
+	}
+	m := chunkManifest{nonce: data[:8]}
+	data = data[8:]
+
+	count, n := binary.Uvarint(data)
+	if n <= 0 {
+		return chunkManifest{}, errMalformed
+	}
+	data = data[n:]
+	size, n := binary.Uvarint(data)
+	if n <= 0 || len(data[n:]) != 4 || count > size {
+		return chunkManifest{}, errMalformed
+	}
+	m.count, m.size = int(count), int(size)
+	m.checksum = binary.LittleEndian.Uint32(data[n:])
+	return m, nil
+}
+
+func (m chunkManifest) keys(memcacheKey string) []string {
+	keys := make([]string, m.count)
+	for i := range keys {
+		keys[i] = createChunkMemcacheKey(memcacheKey, m.nonce, i)
+	}
+	return keys
+}
+
+// join reassembles the payload from chunks, which must hold every chunk
+// listed by m.
+func (m chunkManifest) join(memcacheKey string,
+	chunks map[string]*Item) ([]byte, bool) {
+
+	buf := bytes.NewBuffer(make([]byte, 0, m.size))
+	for _, key := range m.keys(memcacheKey) {
+		chunk, ok := chunks[key]
+		if !ok || chunk.Flags != chunkItem {
+			return nil, false
+		}
+		buf.Write(chunk.Value)
+	}
+	data := buf.Bytes()
+	if len(data) != m.size || crc32.ChecksumIEEE(data) != m.checksum {
+		return nil, false
+	}
+	return data, true
+}
+
+// loadChunks replaces each chunked item in items with an entity item holding
+// its reassembled payload. Chunked items whose chunks are missing or don't
+// match their manifest are left in place for the caller to treat as a miss.
+func (cl *Client) loadChunks(c context.Context, items map[string]*Item) {
+	manifests := map[string]chunkManifest{}
+	chunkKeys := []string{}
+	for key, item := range items {
+		if item.Flags != chunkedItem {
+			continue
+		}
+		m, err := decodeChunkManifest(item.Value)
+		if err != nil {
+			cl.warn(c, "loadChunks", "decodeChunkManifest failed", err,
+				"memcache_key", key)
+			continue
+		}
+		manifests[key] = m
+		chunkKeys = append(chunkKeys, m.keys(key)...)
+	}
+	if len(manifests) == 0 {
+		return
+	}
+
+	chunks, err := cl.memcacheGetMulti(c, chunkKeys)
+	if err != nil {
+		cl.warn(c, "loadChunks", "cache GetMulti failed", err,
+			"keys", len(chunkKeys))
+		return
+	}
+
+	for key, m := range manifests {
+		if data, ok := m.join(key, chunks); ok {
+			items[key] = &Item{
+				Key:   key,
+				Flags: entityItem,
+				Value: data,
+			}
+		}
+	}
+}
+
+// relockChunked swaps the chunked item for a lock so that the entity can be
+// loaded and cached again. It returns the lock, or nil if the item changed
+// since it was read.
+func (cl *Client) relockChunked(c context.Context, item *Item) *Item {
+	lock := &Item{
+		Key:        item.Key,
+		Flags:      lockItem,
+		Value:      itemLock(),
+		Expiration: memcacheLockTime,
+	}
+	lock.SetCASInfo(item.CASInfo())
+	if err := cl.memcacheCompareAndSwapMulti(c, []*Item{lock}); err != nil {
+		cl.debug(c, "relockChunked", "cache CompareAndSwapMulti failed", err,
+			"memcache_key", item.Key)
+		return nil
+	}
+	return lock
+}
+
+// deleteChunks removes the chunks of cacheItems whose manifests were not
+// saved.
+func (cl *Client) deleteChunks(c context.Context, cacheItems []cacheItem) {
+	keys := []string{}
+	for _, cacheItem := range cacheItems {
+		for _, chunk := range cacheItem.chunks {
+			keys = append(keys, chunk.Key)
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+	if err := cl.memcacheDeleteMulti(c, keys); err != nil {
+		cl.debug(c, "deleteChunks", "cache DeleteMulti failed", err,
+			"keys", len(keys))
+	}
+}
+
+func joinChunks(chunks []*Item) []byte {
+	data := []byte{}
+	for _, chunk := range chunks {
+		data = append(data, chunk.Value...)
+	}
+	return data
+}
+
+func createChunkMemcacheKey(memcacheKey string, nonce []byte, i int) string {
+	return hashMemcacheKey(memcachePrefix + "chunk:" + memcacheKey + ":" +
+		hex.EncodeToString(nonce) + ":" + strconv.Itoa(i))
+}
@@ -0,0 +1,102 @@
+package nds_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yoavfeld/nds"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestClientChunkedEntity(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val string `datastore:",noindex"`
+	}
+
+	cache := newMemoryCache()
+	cl, err := nds.NewClient(nds.DsClient(), nds.WithCache(cache),
+		nds.WithMaxItemSize(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := datastore.IDKey("ChunkEntity", 1, nil)
+	want := &testEntity{strings.Repeat("abcdefgh", 1024)}
+	if _, err := cl.Put(c, key, want); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func() {
+		got := &testEntity{}
+		if err := cl.Get(c, key, got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Val != want.Val {
+			t.Fatal("incorrect entity")
+		}
+	}
+	chunkKeys := func() []string {
+		cache.Lock()
+		defer cache.Unlock()
+		keys := []string{}
+		for key, item := range cache.items {
+			if item.Flags == nds.ChunkItem {
+				keys = append(keys, key)
+			}
+		}
+		return keys
+	}
+
+	memcacheKey := nds.CreateMemcacheKey(key)
+	manifest := func() []byte {
+		items, err := cache.GetMulti(c, []string{memcacheKey})
+		if err != nil {
+			t.Fatal(err)
+		}
+		item, ok := items[memcacheKey]
+		if !ok || item.Flags == nds.EntityItem || item.Flags == nds.LockItem {
+			t.Fatal("expected chunk manifest")
+		}
+		return item.Value
+	}
+
+	// Cache the entity and then read it back from the chunks.
+	get()
+	first := manifest()
+	keys := chunkKeys()
+	if len(keys) < 8 {
+		t.Fatal("expected chunks", len(keys))
+	}
+	get()
+
+	// A missing chunk is a miss and the entity is cached again.
+	if err := cache.DeleteMulti(c, keys[:1]); err != nil {
+		t.Fatal(err)
+	}
+	get()
+	if bytes.Equal(manifest(), first) {
+		t.Fatal("expected a new manifest")
+	}
+	get()
+
+	// Rewriting the entity leaves the old chunks behind, but they expire.
+	if _, err := cl.Put(c, key, want); err != nil {
+		t.Fatal(err)
+	}
+	get()
+	keys = chunkKeys()
+	cache.Lock()
+	defer cache.Unlock()
+	for _, key := range keys {
+		item := cache.items[key]
+		if item.Expiration <= 0 || item.Expiration > 24*time.Hour {
+			t.Fatal("expected the chunk to expire", key, item.Expiration)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package nds
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/bradfitz/gomemcache/memcache"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+)
+
+// Client caches datastore calls made through a *datastore.Client in a
+// Cache. Create one with NewClient. A Client is safe for concurrent use by
+// multiple goroutines.
+type Client struct {
+	ds         *datastore.Client
+	cache      Cache
+	localCache *localCache
+	flights    *flightGroup
+	codec      Codec
+
+	cacheTimeout time.Duration
+	breaker      *circuitBreaker
+	journal      *journal
+
+	compression          Compression
+	compressionThreshold int
+	maxItemSize          int
+
+	logger  Logger
+	metrics Metrics
+	tracer  trace.Tracer
+
+	queryCache    bool
+	queryCacheTTL time.Duration
+
+	cachePolicies map[string]CachePolicy
+
+	// The fields in this block are here so that we can test all error code
+	// paths by substituting them with error producing ones.
+	datastoreDeleteMulti func(c context.Context, keys []*datastore.Key) error
+	datastoreGetMulti    func(c context.Context,
+		keys []*datastore.Key, vals interface{}) error
+	datastorePutMulti func(c context.Context,
+		keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error)
+
+	memcacheAddMulti            func(c context.Context, items []*Item) error
+	memcacheCompareAndSwapMulti func(c context.Context, items []*Item) error
+	memcacheDeleteMulti         func(c context.Context, keys []string) error
+	memcacheGetMulti            func(c context.Context,
+		keys []string) (map[string]*Item, error)
+	memcacheSetMulti func(c context.Context, items []*Item) error
+
+	marshal   func(pl datastore.PropertyList) ([]byte, error)
+	unmarshal func(data []byte, pl *datastore.PropertyList) error
+}
+
+// ClientOption configures a Client created by NewClient.
+type ClientOption func(*Client)
+
+// WithCache makes the Client cache entities in cache.
+func WithCache(cache Cache) ClientOption {
+	return func(cl *Client) {
+		cl.cache = cache
+	}
+}
+
+// WithMemcacheClient makes the Client cache entities in the memcache servers
+// mc is connected to.
+func WithMemcacheClient(mc *memcache.Client) ClientOption {
+	return WithCache(&memcacheClient{mc})
+}
+
+// WithCodec sets the Codec used to serialize cached entities. The default is
+// GobCodec. Entities cached with a different codec can't be read and are
+// loaded from the datastore until they are written again or evicted.
+func WithCodec(codec Codec) ClientOption {
+	return func(cl *Client) {
+		cl.codec = codec
+	}
+}
+
+// WithLocalCache adds an in-process LRU cache of up to size entities in front
+// of the Cache so repeated reads of the same entity skip the network. Local
+// puts and deletes invalidate it, but entities written by other processes can
+// be served stale for up to ttl, so keep ttl short.
+func WithLocalCache(size int, ttl time.Duration) ClientOption {
+	return func(cl *Client) {
+		if size > 0 {
+			cl.localCache = newLocalCache(size, ttl)
+		}
+	}
+}
+
+// WithQueryCache makes RunQuery cache the keys matched by each query for up
+// to ttl, or until an entity of the queried kind is put or deleted through
+// nds. Every Client and process that writes the cached kinds must enable it
+// for the invalidation to work.
+func WithQueryCache(ttl time.Duration) ClientOption {
+	return func(cl *Client) {
+		cl.queryCache = true
+		cl.queryCacheTTL = ttl
+	}
+}
+
+// NewClient creates a Client that reads and writes entities through ds and
+// caches them in the cache backend given by opts.
+func NewClient(ds *datastore.Client, opts ...ClientOption) (*Client, error) {
+	if ds == nil {
+		return nil, errors.New("nds: nil datastore client")
+	}
+
+	cl := &Client{ds: ds, codec: GobCodec{}, maxItemSize: defaultMaxItemSize}
+	for _, opt := range opts {
+		opt(cl)
+	}
+	if cl.cache == nil {
+		return nil, errors.New("nds: no cache backend configured")
+	}
+	if cl.maxItemSize <= 0 {
+		return nil, errors.New("nds: max item size must be positive")
+	}
+	if cl.compression > ZstdCompression {
+		return nil, fmt.Errorf("nds: unknown compression %d", cl.compression)
+	}
+	if b := cl.breaker; b != nil && (b.errorRate <= 0 || b.errorRate > 1 ||
+		b.window <= 0 || b.openTime <= 0) {
+		return nil, errors.New("nds: invalid circuit breaker settings")
+	}
+	for kind, policy := range cl.cachePolicies {
+		if policy.TTL < 0 || policy.MaxItemSize < 0 {
+			return nil, fmt.Errorf("nds: invalid cache policy for kind %s",
+				kind)
+		}
+	}
+	if cl.journal != nil && cl.journal.kind == "" {
+		return nil, errors.New("nds: degraded writes need a journal kind")
+	}
+
+	cl.datastoreDeleteMulti = cl.ds.DeleteMulti
+	cl.datastoreGetMulti = cl.ds.GetMulti
+	cl.datastorePutMulti = cl.ds.PutMulti
+
+	cache := cl.cache
+	if cl.cacheTimeout > 0 {
+		cache = &timeoutCache{cache, cl.cacheTimeout}
+	}
+	if cl.breaker != nil {
+		cache = &breakerCache{cache, cl}
+	}
+	cache = &nonEmptyCache{cache}
+	cl.memcacheAddMulti = cache.AddMulti
+	cl.memcacheCompareAndSwapMulti = cache.CompareAndSwapMulti
+	cl.memcacheDeleteMulti = cache.DeleteMulti
+	cl.memcacheGetMulti = cache.GetMulti
+	cl.memcacheSetMulti = cache.SetMulti
+
+	cl.marshal = cl.codec.Marshal
+	if cl.compression != NoCompression {
+		cl.marshal = compressMarshal(cl.marshal, cl.compression,
+			cl.compressionThreshold)
+	}
+	cl.unmarshal = decompressUnmarshal(cl.codec.Unmarshal)
+	return cl, nil
+}
+
+// defaultClient is the Client used by the package level functions such as
+// Get, Put and Delete.
+var defaultClient *Client
+
+// InitNDS creates the default Client used by the package level functions. It
+// connects to the datastore of datastoreProjectID and to the memcache servers
+// at memcacheAddr, a comma separated list of addresses.
+func InitNDS(c context.Context, memcacheAddr, datastoreProjectID string) error {
+	ds, err := datastore.NewClient(c, datastoreProjectID)
+	if err != nil {
+		return fmt.Errorf("failed to create datastore client")
+	}
+
+	cl, err := NewClient(ds,
+		WithCache(NewMemcache(strings.Split(memcacheAddr, ",")...)))
+	if err != nil {
+		return err
+	}
+	defaultClient = cl
+	return nil
+}
+
+// SetDefaultClient replaces the Client used by the package level functions.
+func SetDefaultClient(cl *Client) {
+	defaultClient = cl
+}
+
+func getDefaultClient() *Client {
+	if defaultClient == nil {
+		panic("nds: default client was not initialized. did you call nds.InitNDS ?")
+	}
+	return defaultClient
+}
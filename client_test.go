@@ -0,0 +1,73 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/yoavfeld/nds"
+
+	"cloud.google.com/go/datastore"
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+func TestNewClientErrors(t *testing.T) {
+	if _, err := nds.NewClient(nil); err == nil {
+		t.Fatal("expected nil datastore client error")
+	}
+
+	if _, err := nds.NewClient(nds.DsClient()); err == nil {
+		t.Fatal("expected no cache backend error")
+	}
+
+	if _, err := nds.NewClient(nds.DsClient(), nds.WithCache(newMemoryCache()),
+		nds.WithCompression(nds.Compression(15), 0)); err == nil {
+		t.Fatal("expected unknown compression error")
+	}
+}
+
+func TestClientPutGetDelete(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	cl, err := nds.NewClient(nds.DsClient(),
+		nds.WithMemcacheClient(memcache.New(memcacheAddr)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := datastore.IDKey("Entity", 1, nil)
+	if _, err := cl.Put(c, key, &testEntity{42}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Get from datastore, then from cache.
+	for i := 0; i < 2; i++ {
+		te := &testEntity{}
+		if err := cl.Get(c, key, te); err != nil {
+			t.Fatal(err)
+		}
+		if te.IntVal != 42 {
+			t.Fatal("te.IntVal != 42", te.IntVal)
+		}
+	}
+
+	// The default client shares the same cache and datastore.
+	te := &testEntity{}
+	if err := nds.Get(c, key, te); err != nil {
+		t.Fatal(err)
+	}
+	if te.IntVal != 42 {
+		t.Fatal("te.IntVal != 42", te.IntVal)
+	}
+
+	if err := cl.Delete(c, key); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := nds.Get(c, key, &testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity")
+	}
+}
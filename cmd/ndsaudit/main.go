@@ -0,0 +1,108 @@
+// Command ndsaudit compares the entities cached by nds with the datastore and
+// prints the cache items that are stale, locked or can't be decoded.
+//
+//	ndsaudit -project my-project -memcache localhost:11211 -kind User
+//
+// It checks every entity of the kind, or the first -limit of them. With
+// -repair it drops the stale and undecodable items so they are cached again.
+// The exit status is 1 if problems were found, and 2 on error.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/yoavfeld/nds"
+
+	"cloud.google.com/go/datastore"
+	"golang.org/x/net/context"
+)
+
+func main() {
+	project := flag.String("project", "", "datastore project ID")
+	memcacheAddr := flag.String("memcache", "localhost:11211",
+		"comma separated memcache server addresses")
+	kind := flag.String("kind", "", "kind of the entities to audit")
+	namespace := flag.String("namespace", "", "datastore namespace")
+	limit := flag.Int("limit", 0, "maximum number of entities to audit")
+	codec := flag.String("codec", "gob",
+		"codec of the cached entities: gob or binary")
+	repair := flag.Bool("repair", false,
+		"drop stale and undecodable cache items")
+	flag.Parse()
+
+	if *project == "" || *kind == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	problems, err := audit(*project, *memcacheAddr, *kind, *namespace,
+		*limit, *codec, *repair)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ndsaudit:", err)
+		os.Exit(2)
+	}
+	if problems > 0 {
+		os.Exit(1)
+	}
+}
+
+func audit(project, memcacheAddr, kind, namespace string, limit int,
+	codec string, repair bool) (int, error) {
+
+	opts := []nds.ClientOption{
+		nds.WithCache(nds.NewMemcache(strings.Split(memcacheAddr, ",")...)),
+	}
+	switch codec {
+	case "gob":
+	case "binary":
+		opts = append(opts, nds.WithCodec(nds.BinaryCodec{}))
+	default:
+		return 0, fmt.Errorf("unknown codec %q", codec)
+	}
+
+	c := context.Background()
+	ds, err := datastore.NewClient(c, project)
+	if err != nil {
+		return 0, err
+	}
+	defer ds.Close()
+	cl, err := nds.NewClient(ds, opts...)
+	if err != nil {
+		return 0, err
+	}
+
+	q := datastore.NewQuery(kind).Namespace(namespace).KeysOnly()
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+	keys, err := ds.GetAll(c, q, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	auditOpts := []nds.AuditOption{}
+	if repair {
+		auditOpts = append(auditOpts, nds.AuditRepair())
+	}
+	results, err := cl.Audit(c, keys, auditOpts...)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, result := range results {
+		line := fmt.Sprintf("%s\t%s", result.Problem, result.Key)
+		if result.Err != nil {
+			line += "\t" + result.Err.Error()
+		}
+		if result.Repaired {
+			line += "\trepaired"
+		}
+		fmt.Println(line)
+	}
+	fmt.Fprintf(os.Stderr, "%d entities audited, %d problems\n",
+		len(keys), len(results))
+	return len(results), nil
+}
@@ -0,0 +1,27 @@
+package nds
+
+import (
+	"cloud.google.com/go/datastore"
+)
+
+// Codec serializes the property lists of entities stored in the Cache. Every
+// Client and process sharing a Cache must use the same Codec. Marshal must not
+// return data starting with a byte in the range 0x80 to 0x8f as those bytes
+// mark compressed payloads.
+type Codec interface {
+	Marshal(pl datastore.PropertyList) ([]byte, error)
+	Unmarshal(data []byte, pl *datastore.PropertyList) error
+}
+
+// GobCodec is the default Codec. It uses encoding/gob.
+type GobCodec struct{}
+
+// Marshal implements Codec.
+func (GobCodec) Marshal(pl datastore.PropertyList) ([]byte, error) {
+	return marshalPropertyList(pl)
+}
+
+// Unmarshal implements Codec.
+func (GobCodec) Unmarshal(data []byte, pl *datastore.PropertyList) error {
+	return unmarshalPropertyList(data, pl)
+}
@@ -0,0 +1,148 @@
+package nds_test
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/yoavfeld/nds"
+
+	"cloud.google.com/go/datastore"
+)
+
+func codecTestPropertyList() datastore.PropertyList {
+	parent := datastore.NameKey("Parent", "p", nil)
+	key := datastore.IDKey("Child", 7, parent)
+	return datastore.PropertyList{
+		{Name: "nil", Value: nil},
+		{Name: "int", Value: int64(-42)},
+		{Name: "bool", Value: true},
+		{Name: "string", Value: "value", NoIndex: true},
+		{Name: "float", Value: 3.5},
+		{Name: "key", Value: key},
+		{Name: "time", Value: time.Unix(1234567890, 123456000)},
+		{Name: "bytes", Value: []byte{1, 2, 3}},
+		{Name: "geo", Value: datastore.GeoPoint{Lat: 51.5, Lng: -0.1}},
+		{Name: "entity", Value: &datastore.Entity{
+			Key: key,
+			Properties: []datastore.Property{
+				{Name: "nested", Value: "n"},
+			},
+		}},
+		{Name: "array", Value: []interface{}{int64(1), "two",
+			datastore.GeoPoint{Lat: 1, Lng: 2}}},
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	codecs := []nds.Codec{nds.GobCodec{}, nds.BinaryCodec{}}
+	for _, codec := range codecs {
+		pl := codecTestPropertyList()
+		data, err := codec.Marshal(pl)
+		if err != nil {
+			t.Fatalf("%T: %s", codec, err)
+		}
+
+		got := datastore.PropertyList{}
+		if err := codec.Unmarshal(data, &got); err != nil {
+			t.Fatalf("%T: %s", codec, err)
+		}
+		if len(got) != len(pl) {
+			t.Fatalf("%T: incorrect length %d", codec, len(got))
+		}
+		for i := range pl {
+			if got[i].Name != pl[i].Name || got[i].NoIndex != pl[i].NoIndex {
+				t.Fatalf("%T: incorrect property %+v", codec, got[i])
+			}
+			want, gotVal := pl[i].Value, got[i].Value
+			if wt, ok := want.(time.Time); ok {
+				if gt, ok := gotVal.(time.Time); !ok || !gt.Equal(wt) {
+					t.Fatalf("%T: incorrect time %v", codec, gotVal)
+				}
+				continue
+			}
+			if !reflect.DeepEqual(gotVal, want) {
+				t.Fatalf("%T: incorrect %s value %#v", codec, pl[i].Name,
+					gotVal)
+			}
+		}
+	}
+}
+
+func TestBinaryCodecDeterministic(t *testing.T) {
+	codec := nds.BinaryCodec{}
+	a, err := codec.Marshal(codecTestPropertyList())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := codec.Marshal(codecTestPropertyList())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(a, b) {
+		t.Fatal("expected identical encodings")
+	}
+
+	// Truncated data must not decode.
+	pl := datastore.PropertyList{}
+	if err := codec.Unmarshal(a[:len(a)-1], &pl); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestBinaryCodecUnsupportedType(t *testing.T) {
+	pl := datastore.PropertyList{{Name: "int", Value: 1}}
+	if _, err := (nds.BinaryCodec{}).Marshal(pl); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestClientWithCodec(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val  int
+		Geo  datastore.GeoPoint
+		Tags []string
+	}
+
+	cache := newMemoryCache()
+	cl, err := nds.NewClient(nds.DsClient(), nds.WithCache(cache),
+		nds.WithCodec(nds.BinaryCodec{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := datastore.IDKey("CodecEntity", 1, nil)
+	want := &testEntity{2, datastore.GeoPoint{Lat: 1, Lng: 2},
+		[]string{"a", "b"}}
+	if _, err := cl.Put(c, key, want); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first get caches the entity and the second reads it back.
+	for i := 0; i < 2; i++ {
+		got := &testEntity{}
+		if err := cl.Get(c, key, got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatal("incorrect entity", got)
+		}
+	}
+
+	items, err := cache.GetMulti(c, []string{nds.CreateMemcacheKey(key)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	item, ok := items[nds.CreateMemcacheKey(key)]
+	if !ok || item.Flags != nds.EntityItem {
+		t.Fatal("expected cached entity")
+	}
+	pl := datastore.PropertyList{}
+	if err := (nds.BinaryCodec{}).Unmarshal(item.Value, &pl); err != nil {
+		t.Fatal("expected binary encoding", err)
+	}
+}
@@ -0,0 +1,133 @@
+package nds
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"cloud.google.com/go/datastore"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is an algorithm used to compress cached entities.
+type Compression byte
+
+// The compression algorithms supported by WithCompression.
+const (
+	NoCompression Compression = iota
+	GzipCompression
+	SnappyCompression
+	ZstdCompression
+)
+
+// compressedHeader marks a compressed payload. The low bits of the first byte
+// hold the Compression used. Codec output never starts with a byte in this
+// range, so payloads written before compression was turned on, or that were
+// too small to compress, are stored as is and can be told apart.
+const (
+	compressedHeader     byte = 0x80
+	compressedHeaderMask byte = 0xf0
+)
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// WithCompression compresses cached entities whose encoded size is at least
+// threshold bytes. Compressed entities can be read by every Client regardless
+// of its own compression setting, so it can be turned on or changed without
+// flushing the cache.
+func WithCompression(compression Compression, threshold int) ClientOption {
+	return func(cl *Client) {
+		cl.compression = compression
+		cl.compressionThreshold = threshold
+	}
+}
+
+// compressMarshal returns a marshal func that compresses the output of
+// marshal.
+func compressMarshal(marshal func(pl datastore.PropertyList) ([]byte, error),
+	compression Compression,
+	threshold int) func(pl datastore.PropertyList) ([]byte, error) {
+
+	return func(pl datastore.PropertyList) ([]byte, error) {
+		data, err := marshal(pl)
+		if err != nil || len(data) < threshold {
+			return data, err
+		}
+		compressed, err := compress(compression, data)
+		if err != nil {
+			return nil, err
+		}
+
+		// Not worth it if nothing was saved.
+		if len(compressed) >= len(data) {
+			return data, nil
+		}
+		return compressed, nil
+	}
+}
+
+// decompressUnmarshal returns an unmarshal func that decompresses data before
+// passing it to unmarshal.
+func decompressUnmarshal(
+	unmarshal func(data []byte, pl *datastore.PropertyList) error) func(
+	data []byte, pl *datastore.PropertyList) error {
+
+	return func(data []byte, pl *datastore.PropertyList) error {
+		data, err := decompress(data)
+		if err != nil {
+			return err
+		}
+		return unmarshal(data, pl)
+	}
+}
+
+func compress(compression Compression, data []byte) ([]byte, error) {
+	header := []byte{compressedHeader | byte(compression)}
+	switch compression {
+	case GzipCompression:
+		buf := bytes.NewBuffer(header)
+		w := gzip.NewWriter(buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case SnappyCompression:
+		return append(header, snappy.Encode(nil, data)...), nil
+	case ZstdCompression:
+		return zstdEncoder.EncodeAll(data, header), nil
+	default:
+		return nil, fmt.Errorf("nds: unknown compression %d", compression)
+	}
+}
+
+func decompress(data []byte) ([]byte, error) {
+	if len(data) == 0 || data[0]&compressedHeaderMask != compressedHeader {
+		return data, nil
+	}
+
+	compression := Compression(data[0] &^ compressedHeaderMask)
+	data = data[1:]
+	switch compression {
+	case GzipCompression:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	case SnappyCompression:
+		return snappy.Decode(nil, data)
+	case ZstdCompression:
+		return zstdDecoder.DecodeAll(data, nil)
+	default:
+		return nil, fmt.Errorf("nds: unknown compression %d", compression)
+	}
+}
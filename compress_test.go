@@ -0,0 +1,87 @@
+package nds_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/yoavfeld/nds"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestClientWithCompression(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val string `datastore:",noindex"`
+	}
+
+	compressions := []nds.Compression{
+		nds.GzipCompression,
+		nds.SnappyCompression,
+		nds.ZstdCompression,
+	}
+	for _, compression := range compressions {
+		cache := newMemoryCache()
+		cl, err := nds.NewClient(nds.DsClient(), nds.WithCache(cache),
+			nds.WithCompression(compression, 1024))
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain, err := nds.NewClient(nds.DsClient(), nds.WithCache(cache))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys := []*datastore.Key{
+			datastore.IDKey("CompressEntity", 1, nil),
+			datastore.IDKey("CompressEntity", 2, nil),
+		}
+		entities := []testEntity{
+			{strings.Repeat("a", 1<<16)},
+			{"small"},
+		}
+		if _, err := cl.PutMulti(c, keys, entities); err != nil {
+			t.Fatal(err)
+		}
+
+		// Cache the large entity through the compressing client and the
+		// small one through a client without compression.
+		if err := cl.Get(c, keys[0], &testEntity{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := plain.Get(c, keys[1], &testEntity{}); err != nil {
+			t.Fatal(err)
+		}
+
+		memcacheKeys := []string{
+			nds.CreateMemcacheKey(keys[0]),
+			nds.CreateMemcacheKey(keys[1]),
+		}
+		items, err := cache.GetMulti(c, memcacheKeys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		large, small := items[memcacheKeys[0]], items[memcacheKeys[1]]
+		if large == nil || len(large.Value) >= len(entities[0].Val) {
+			t.Fatal("expected compressed entity", compression)
+		}
+		if small == nil || small.Value[0]&0xf0 == 0x80 {
+			t.Fatal("expected uncompressed entity", compression)
+		}
+
+		// Both clients can read both items.
+		for _, client := range []*nds.Client{cl, plain} {
+			got := make([]testEntity, 2)
+			if err := client.GetMulti(c, keys, got); err != nil {
+				t.Fatal(err)
+			}
+			for i := range got {
+				if got[i].Val != entities[i].Val {
+					t.Fatal("incorrect entity", compression, i)
+				}
+			}
+		}
+	}
+}
@@ -2,21 +2,37 @@ package nds
 
 import (
 	"sync"
+	"time"
 
 	"golang.org/x/net/context"
 	"cloud.google.com/go/datastore"
-	"github.com/bradfitz/gomemcache/memcache"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // deleteMultiLimit is the App Engine datastore limit for the maximum number
 // of entities that can be deleted by datastore.DeleteMulti at once.
 const deleteMultiLimit = 500
 
+// DeleteMulti calls Client.DeleteMulti on the default client.
+func DeleteMulti(c context.Context, keys []*datastore.Key) error {
+	return getDefaultClient().DeleteMulti(c, keys)
+}
+
+// Delete calls Client.Delete on the default client.
+func Delete(c context.Context, key *datastore.Key) error {
+	return getDefaultClient().Delete(c, key)
+}
+
 // DeleteMulti works just like datastore.DeleteMulti except it maintains
 // cache consistency with other NDS methods. It also removes the API limit of
 // 500 entities per request by calling the datastore as many times as required
 // to put all the keys. It does this efficiently and concurrently.
-func DeleteMulti(c context.Context, keys []*datastore.Key) error {
+func (cl *Client) DeleteMulti(c context.Context,
+	keys []*datastore.Key) (err error) {
+	defer cl.observeLatency(c, "DeleteMulti", keysKind(keys), time.Now())
+	c, span := cl.startSpan(c, "nds.DeleteMulti",
+		attribute.Int("nds.keys", len(keys)))
+	defer func() { endSpan(span, err) }()
 
 	callCount := (len(keys)-1)/deleteMultiLimit + 1
 	errs := make([]error, callCount)
@@ -31,7 +47,11 @@ func DeleteMulti(c context.Context, keys []*datastore.Key) error {
 		}
 
 		go func(i int, keys []*datastore.Key) {
-			errs[i] = deleteMulti(c, keys)
+			c, span := cl.startSpan(c, "nds.DeleteMulti.batch",
+				attribute.Int("nds.batch", i),
+				attribute.Int("nds.keys", len(keys)))
+			errs[i] = cl.deleteMulti(c, keys)
+			endSpan(span, errs[i])
 			wg.Done()
 		}(i, keys[lo:hi])
 	}
@@ -45,34 +65,42 @@ func DeleteMulti(c context.Context, keys []*datastore.Key) error {
 }
 
 // Delete deletes the entity for the given key.
-func Delete(c context.Context, key *datastore.Key) error {
+func (cl *Client) Delete(c context.Context, key *datastore.Key) (err error) {
+	defer cl.observeLatency(c, "Delete", keysKind([]*datastore.Key{key}),
+		time.Now())
+	c, span := cl.startSpan(c, "nds.Delete")
+	defer func() { endSpan(span, err) }()
+
 	if key == nil {
 		return datastore.ErrInvalidKey
 	}
-	err := deleteMulti(c, []*datastore.Key{key})
+	err = cl.deleteMulti(c, []*datastore.Key{key})
 	if me, ok := err.(datastore.MultiError); ok {
 		return me[0]
 	}
 	return err
 }
 
-func deleteMulti(c context.Context, keys []*datastore.Key) error {
+func (cl *Client) deleteMulti(c context.Context, keys []*datastore.Key) error {
 
-	lockMemcacheItems := []*memcache.Item{}
+	lockMemcacheKeys := []string{}
+	lockMemcacheItems := []*Item{}
 	for _, key := range keys {
 		// Worst case scenario is that we lock the entity for memcacheLockTime.
 		// datastore.Delete will raise the appropriate error.
-		if key == nil || key.Incomplete() {
+		if key == nil || key.Incomplete() ||
+			cl.writePolicy(key.Kind).NoCache {
 			continue
 		}
 
-		item := &memcache.Item{
+		item := &Item{
 			Key:        createMemcacheKey(key),
 			Flags:      lockItem,
 			Value:      itemLock(),
 			Expiration: memcacheLockTime,
 		}
 		lockMemcacheItems = append(lockMemcacheItems, item)
+		lockMemcacheKeys = append(lockMemcacheKeys, item.Key)
 	}
 
 	memcacheCtx, err := memcacheContext(c)
@@ -80,16 +108,29 @@ func deleteMulti(c context.Context, keys []*datastore.Key) error {
 		return err
 	}
 
+	// Drop local copies now and again once the delete is done in case a
+	// concurrent Get cached the old entity in the meantime.
+	cl.localCache.delete(lockMemcacheKeys)
+	defer func() {
+		cl.localCache.delete(lockMemcacheKeys)
+		cl.flights.forget(lockMemcacheKeys)
+	}()
+
 	// Make sure we can lock memcache with no errors before deleting.
 	if tx, ok := transactionFromContext(c); ok {
 		tx.Lock()
 		tx.lockMemcacheItems = append(tx.lockMemcacheItems,
 			lockMemcacheItems...)
+		tx.keys = append(tx.keys, keys...)
 		tx.Unlock()
-	} else if err := memcacheSetMulti(memcacheCtx,
-		lockMemcacheItems); err != nil {
+	} else if err := cl.lockCache(memcacheCtx, lockMemcacheItems,
+		keys); err != nil {
 		return err
 	}
 
-	return datastoreDeleteMulti(c, keys)
+	err = cl.datastoreDeleteMulti(c, keys)
+	if _, ok := transactionFromContext(c); !ok {
+		cl.invalidateQueries(memcacheCtx, keys)
+	}
+	return err
 }
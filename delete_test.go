@@ -10,7 +10,6 @@ import (
 
 	"golang.org/x/net/context"
 	"cloud.google.com/go/datastore"
-	"github.com/bradfitz/gomemcache/memcache"
 )
 
 func TestDeleteMulti(t *testing.T) {
@@ -98,12 +97,12 @@ func TestDeleteMemcacheFail(t *testing.T) {
 	}
 
 	nds.SetMemcacheSetMulti(func(c context.Context,
-		items []*memcache.Item) error {
+		items []*nds.Item) error {
 		return errors.New("expected error")
 	})
 
 	defer func() {
-		nds.SetMemcacheSetMulti(nds.McClient.SetMulti)
+		nds.SetMemcacheSetMulti(nds.McClient().SetMulti)
 	}()
 
 	if err := nds.DeleteMulti(c, keys); err == nil {
@@ -2,6 +2,7 @@ package nds
 
 import (
 	"reflect"
+	"time"
 
 	"golang.org/x/net/context"
 	"cloud.google.com/go/datastore"
@@ -14,50 +15,97 @@ var (
 
 	NoneItem   = noneItem
 	EntityItem = entityItem
+	LockItem   = lockItem
+	ChunkItem  = chunkItem
+
+	GenerationItem = generationItem
 
 	MemcacheMaxKeySize = memcacheMaxKeySize
+
+	JournalRetryInterval = journalRetryInterval
 )
 
+// DsClient returns the datastore client behind the default Client.
+func DsClient() *datastore.Client {
+	return defaultClient.ds
+}
+
+// McClient returns the cache behind the default Client.
+func McClient() Cache {
+	return defaultClient.cache
+}
+
+func NewMemcacheCache(mc *memcache.Client) Cache {
+	return &memcacheClient{mc}
+}
+
+// MemcacheRing returns a function that reports which of the servers at
+// addrs a NewMemcache cache places a key on.
+func MemcacheRing(addrs ...string) func(key string) string {
+	ring := newMemcacheRing(addrs, nil)
+	return func(key string) string {
+		return ring.server(key).addr
+	}
+}
+
+// MemcacheCASInfo returns the compare and swap state NewMemcache caches keep
+// for an item with the memcache cas unique value cas.
+func MemcacheCASInfo(cas uint64) interface{} {
+	return memcacheCAS(cas)
+}
+
+// MemcacheExpiration returns the memcache expiration NewMemcache caches send
+// for an item that expires after d.
+func MemcacheExpiration(d time.Duration) int64 {
+	return memcacheExpiration(d)
+}
+
 func SetMemcacheAddMulti(f func(c context.Context,
-	items []*memcache.Item) error) {
-	memcacheAddMulti = f
+	items []*Item) error) {
+	defaultClient.memcacheAddMulti = f
 }
 
 func SetMemcacheCompareAndSwapMulti(f func(c context.Context,
-	items []*memcache.Item) error) {
-	memcacheCompareAndSwapMulti = f
+	items []*Item) error) {
+	defaultClient.memcacheCompareAndSwapMulti = f
 }
 
 func SetMemcacheDeleteMulti(f func(c context.Context, keys []string) error) {
-	memcacheDeleteMulti = f
+	defaultClient.memcacheDeleteMulti = f
 }
 
 func SetMemcacheGetMulti(f func(c context.Context,
-	keys []string) (map[string]*memcache.Item, error)) {
-	memcacheGetMulti = f
+	keys []string) (map[string]*Item, error)) {
+	defaultClient.memcacheGetMulti = f
 }
 
 func SetMemcacheSetMulti(f func(c context.Context,
-	items []*memcache.Item) error) {
-	memcacheSetMulti = f
+	items []*Item) error) {
+	defaultClient.memcacheSetMulti = f
 }
 
 func SetDatastorePutMulti(f func(c context.Context,
 	keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error)) {
-	datastorePutMulti = f
+	defaultClient.datastorePutMulti = f
 }
 
 func SetDatastoreGetMulti(f func(c context.Context,
 	keys []*datastore.Key, vals interface{}) error) {
-	datastoreGetMulti = f
+	defaultClient.datastoreGetMulti = f
+}
+
+// SetClientDatastoreGetMulti replaces the datastore reads of cl.
+func SetClientDatastoreGetMulti(cl *Client, f func(c context.Context,
+	keys []*datastore.Key, vals interface{}) error) {
+	cl.datastoreGetMulti = f
 }
 
 func SetMarshal(f func(pl datastore.PropertyList) ([]byte, error)) {
-	marshal = f
+	defaultClient.marshal = f
 }
 
 func SetUnmarshal(f func(data []byte, pl *datastore.PropertyList) error) {
-	unmarshal = f
+	defaultClient.unmarshal = f
 }
 
 func SetValue(val reflect.Value, pl datastore.PropertyList) error {
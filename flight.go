@@ -0,0 +1,154 @@
+package nds
+
+import (
+	"sync"
+
+	"cloud.google.com/go/datastore"
+)
+
+// WithCoalescedLoads makes concurrent calls that have to load the same
+// entity from the datastore share a single read. Each caller still gets its
+// own copy of the entity.
+//
+// A call only shares reads that started after it did, so it never gets an
+// entity older than one it could have read itself.
+func WithCoalescedLoads() ClientOption {
+	return func(cl *Client) {
+		cl.flights = &flightGroup{flights: map[string]*flight{}}
+	}
+}
+
+// flight is a datastore read of one entity that other calls can wait for.
+type flight struct {
+	seq  uint64
+	done chan struct{}
+	pl   datastore.PropertyList
+	err  error
+}
+
+// result returns a deep copy of the flight's entity once it has landed.
+func (f *flight) result() (datastore.PropertyList, error) {
+	return copyPropertyList(f.pl), f.err
+}
+
+// flightGroup tracks the datastore reads in progress by memcache key. A nil
+// *flightGroup starts no flights.
+type flightGroup struct {
+	mu      sync.Mutex
+	seq     uint64
+	flights map[string]*flight
+}
+
+// snapshot returns the sequence number of the latest flight. A call takes it
+// before it reads the cache and only joins flights started after it.
+func (g *flightGroup) snapshot() uint64 {
+	if g == nil {
+		return 0
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.seq
+}
+
+// join returns the flight reading the entity of memcacheKey if it started
+// after snapshot was taken, and otherwise starts one. The caller leads a new
+// flight and must land it.
+func (g *flightGroup) join(memcacheKey string,
+	snapshot uint64) (f *flight, leader bool) {
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if f, ok := g.flights[memcacheKey]; ok && f.seq > snapshot {
+		return f, false
+	}
+	return g.startLocked(memcacheKey), true
+}
+
+// start starts a new flight for memcacheKey that later calls join instead
+// of any earlier one. It is used by calls holding the cache lock, whose read
+// must start after the lock was taken.
+func (g *flightGroup) start(memcacheKey string) *flight {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.startLocked(memcacheKey)
+}
+
+func (g *flightGroup) startLocked(memcacheKey string) *flight {
+	g.seq++
+	f := &flight{seq: g.seq, done: make(chan struct{})}
+	g.flights[memcacheKey] = f
+	return f
+}
+
+// land records the result of f and releases the calls waiting for it.
+func (g *flightGroup) land(memcacheKey string, f *flight,
+	pl datastore.PropertyList, err error) {
+
+	g.mu.Lock()
+	if g.flights[memcacheKey] == f {
+		delete(g.flights, memcacheKey)
+	}
+	g.mu.Unlock()
+
+	f.pl, f.err = pl, err
+	close(f.done)
+}
+
+// forget stops later calls from joining the flights in progress for
+// memcacheKeys, as the entities have been written since they started.
+func (g *flightGroup) forget(memcacheKeys []string) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, memcacheKey := range memcacheKeys {
+		delete(g.flights, memcacheKey)
+	}
+}
+
+// copyPropertyList returns a copy of pl that shares no mutable values with it.
+func copyPropertyList(pl datastore.PropertyList) datastore.PropertyList {
+	if pl == nil {
+		return nil
+	}
+	cp := make(datastore.PropertyList, len(pl))
+	for i, p := range pl {
+		cp[i] = p
+		cp[i].Value = copyPropertyValue(p.Value)
+	}
+	return cp
+}
+
+func copyPropertyValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []byte:
+		return append([]byte(nil), v...)
+	case []interface{}:
+		cp := make([]interface{}, len(v))
+		for i := range v {
+			cp[i] = copyPropertyValue(v[i])
+		}
+		return cp
+	case *datastore.Key:
+		return copyKey(v)
+	case *datastore.Entity:
+		if v == nil {
+			return v
+		}
+		return &datastore.Entity{
+			Key:        copyKey(v.Key),
+			Properties: copyPropertyList(v.Properties),
+		}
+	}
+	return v
+}
+
+func copyKey(key *datastore.Key) *datastore.Key {
+	if key == nil {
+		return nil
+	}
+	cp := *key
+	cp.Parent = copyKey(key.Parent)
+	return &cp
+}
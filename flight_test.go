@@ -0,0 +1,157 @@
+package nds_test
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yoavfeld/nds"
+
+	"cloud.google.com/go/datastore"
+	"golang.org/x/net/context"
+)
+
+// gatedCache is a failingCache whose GetMulti calls wait until gate is
+// closed.
+type gatedCache struct {
+	*failingCache
+	gate chan struct{}
+}
+
+func (gc *gatedCache) GetMulti(c context.Context,
+	keys []string) (map[string]*nds.Item, error) {
+	<-gc.gate
+	return gc.failingCache.GetMulti(c, keys)
+}
+
+func TestClientWithCoalescedLoads(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	cache := &gatedCache{
+		failingCache: &failingCache{memoryCache: newMemoryCache()},
+		gate:         make(chan struct{}),
+	}
+	metrics := newRecordingMetrics()
+	cl, err := nds.NewClient(nds.DsClient(), nds.WithCache(cache),
+		nds.WithCoalescedLoads(), nds.WithMetrics(metrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := datastore.IDKey("CoalescedEntity", 1, nil)
+	if _, err := cl.Put(c, key, &testEntity{42}); err != nil {
+		t.Fatal(err)
+	}
+
+	// With the cache down every call has to read the entity. The calls all
+	// start before the first read, which is held until the other calls are
+	// waiting for it.
+	cache.setDown(true)
+	var reads int32
+	release := make(chan struct{})
+	nds.SetClientDatastoreGetMulti(cl, func(c context.Context,
+		keys []*datastore.Key, vals interface{}) error {
+		if atomic.AddInt32(&reads, 1) == 1 {
+			<-release
+		}
+		return nds.DsClient().GetMulti(c, keys, vals)
+	})
+
+	const calls = 10
+	entities := make([]testEntity, calls)
+	errs := make([]error, calls)
+	wg := sync.WaitGroup{}
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = cl.Get(c, key, &entities[i])
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(cache.gate)
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	for i := 0; i < calls; i++ {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if entities[i].Val != 42 {
+			t.Fatal("incorrect val", entities[i].Val)
+		}
+	}
+	if got := atomic.LoadInt32(&reads); got != 1 {
+		t.Fatal("expected a single datastore read", got)
+	}
+	if got := metrics.get(nds.EventCoalescedLoad,
+		"CoalescedEntity"); got != calls-1 {
+		t.Fatal("incorrect coalesced loads", got)
+	}
+}
+
+func TestCoalescedLoadsAfterWrite(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	cache := newMemoryCache()
+	cl, err := nds.NewClient(nds.DsClient(), nds.WithCache(cache),
+		nds.WithCoalescedLoads())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// other stands in for another process sharing the cache.
+	other, err := nds.NewClient(nds.DsClient(), nds.WithCache(cache))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := datastore.IDKey("CoalescedEntity", 2, nil)
+	if _, err := cl.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first read is held after it has read the entity.
+	var reads int32
+	read := make(chan struct{})
+	release := make(chan struct{})
+	nds.SetClientDatastoreGetMulti(cl, func(c context.Context,
+		keys []*datastore.Key, vals interface{}) error {
+		err := nds.DsClient().GetMulti(c, keys, vals)
+		if atomic.AddInt32(&reads, 1) == 1 {
+			close(read)
+			<-release
+		}
+		return err
+	})
+	errc := make(chan error, 1)
+	go func() {
+		errc <- cl.Get(c, key, &testEntity{})
+	}()
+	<-read
+
+	// A get that starts after another process deleted the entity must not
+	// share the read made before the delete.
+	if err := other.Delete(c, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Get(c, key, &testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected ErrNoSuchEntity", err)
+	}
+
+	close(release)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
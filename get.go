@@ -10,8 +10,7 @@ import (
 
 	"golang.org/x/net/context"
 	"cloud.google.com/go/datastore"
-	"log"
-	"github.com/bradfitz/gomemcache/memcache"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // getMultiLimit is the App Engine datastore limit for the maximum number
@@ -20,6 +19,17 @@ import (
 // datastore.GetMulti as required concurrently and collating the results.
 const getMultiLimit = 1000
 
+// GetMulti calls Client.GetMulti on the default client.
+func GetMulti(c context.Context,
+	keys []*datastore.Key, vals interface{}) error {
+	return getDefaultClient().GetMulti(c, keys, vals)
+}
+
+// Get calls Client.Get on the default client.
+func Get(c context.Context, key *datastore.Key, val interface{}) error {
+	return getDefaultClient().Get(c, key, val)
+}
+
 // GetMulti works similar to datastore.GetMulti except for two important
 // advantages:
 //
@@ -53,13 +63,21 @@ const getMultiLimit = 1000
 // As a special case, datastore.PropertyList is an invalid type for dst, even
 // though a PropertyList is a slice of structs. It is treated as invalid to
 // avoid being mistakenly passed when []datastore.PropertyList was intended.
-func GetMulti(c context.Context,
-	keys []*datastore.Key, vals interface{}) error {
+func (cl *Client) GetMulti(c context.Context,
+	keys []*datastore.Key, vals interface{}) (err error) {
+	defer cl.observeLatency(c, "GetMulti", keysKind(keys), time.Now())
+	c, span := cl.startSpan(c, "nds.GetMulti",
+		attribute.Int("nds.keys", len(keys)))
+	defer func() { endSpan(span, err) }()
 
 	v := reflect.ValueOf(vals)
 	if err := checkKeysValues(keys, v); err != nil {
 		return err
 	}
+	mode, err := cacheModeFromContext(c)
+	if err != nil {
+		return err
+	}
 	callCount := (len(keys)-1)/getMultiLimit + 1
 	errs := make([]error, callCount)
 
@@ -73,11 +91,16 @@ func GetMulti(c context.Context,
 		}
 
 		go func(i int, keys []*datastore.Key, vals reflect.Value) {
-			if _, ok := transactionFromContext(c); ok {
-				errs[i] = datastoreGetMulti(c, keys, vals.Interface())
+			c, span := cl.startSpan(c, "nds.GetMulti.batch",
+				attribute.Int("nds.batch", i),
+				attribute.Int("nds.keys", len(keys)))
+			if tx, ok := transactionFromContext(c); ok {
+				// Join the transaction's snapshot and bypass the cache.
+				errs[i] = tx.tx.GetMulti(keys, vals.Interface())
 			} else {
-				errs[i] = getMulti(c, keys, vals)
+				errs[i] = cl.getMulti(c, keys, vals, mode)
 			}
+			endSpan(span, errs[i])
 			wg.Done()
 		}(i, keys[lo:hi], v.Slice(lo, hi))
 	}
@@ -102,13 +125,14 @@ func GetMulti(c context.Context,
 // type than the one it was stored from, or when a field is missing or
 // unexported in the destination struct. ErrFieldMismatch is only returned if
 // val is a struct pointer.
-func Get(c context.Context, key *datastore.Key, val interface{}) error {
+func (cl *Client) Get(c context.Context,
+	key *datastore.Key, val interface{}) error {
 	// GetMulti catches nil interface; we need to catch nil ptr here.
 	if val == nil {
 		return datastore.ErrInvalidEntityType
 	}
 
-	err := GetMulti(c, []*datastore.Key{key}, []interface{}{val})
+	err := cl.GetMulti(c, []*datastore.Key{key}, []interface{}{val})
 	if me, ok := err.(datastore.MultiError); ok {
 		return me[0]
 	}
@@ -122,6 +146,9 @@ const (
 	internalLock
 	externalLock
 	done
+
+	// bypass is an item whose CachePolicy keeps it out of the cache.
+	bypass
 )
 
 type cacheItem struct {
@@ -131,9 +158,21 @@ type cacheItem struct {
 	val reflect.Value
 	err error
 
-	item *memcache.Item
+	item *Item
+
+	// chunks holds the pieces of a payload too large for item, which is
+	// then the chunk manifest.
+	chunks []*Item
 
-	state cacheState
+	// localSnapshot is the local cache snapshot taken before the cache was
+	// read, which keeps items read before a local write out of it.
+	localSnapshot uint64
+	// flightSnapshot is the flight group snapshot taken before the cache was
+	// read. Only flights started after it can be joined.
+	flightSnapshot uint64
+
+	policy CachePolicy
+	state  cacheState
 }
 
 // getMulti attempts to get entities from, memcache, then the datastore. It also
@@ -141,16 +180,27 @@ type cacheItem struct {
 // that GetMulti will never get stale results even if the function, datastore or
 // server fails at any point. The caching strategy is borrowed from Python ndb
 // with improvements that eliminate some consistency issues surrounding ndb,
-// including http://goo.gl/3ByVlA.
-func getMulti(c context.Context,
-	keys []*datastore.Key, vals reflect.Value) error {
+// including http://goo.gl/3ByVlA. mode can skip or restrict the use of the
+// cache.
+func (cl *Client) getMulti(c context.Context,
+	keys []*datastore.Key, vals reflect.Value, mode CacheMode) error {
 
+	localSnapshot := cl.localCache.snapshot()
+	flightSnapshot := cl.flights.snapshot()
 	cacheItems := make([]cacheItem, len(keys))
 	for i, key := range keys {
+		cacheItems[i].localSnapshot = localSnapshot
+		cacheItems[i].flightSnapshot = flightSnapshot
 		cacheItems[i].key = key
 		cacheItems[i].memcacheKey = createMemcacheKey(key)
 		cacheItems[i].val = vals.Index(i)
-		cacheItems[i].state = miss
+		cacheItems[i].policy = cl.readPolicy(c, key.Kind)
+		if cacheItems[i].policy.NoCache ||
+			!mode.readsCache() && !mode.writesCache() {
+			cacheItems[i].state = bypass
+		} else {
+			cacheItems[i].state = miss
+		}
 	}
 
 	memcacheCtx, err := memcacheContext(c)
@@ -158,15 +208,73 @@ func getMulti(c context.Context,
 		return err
 	}
 
-	loadMemcache(memcacheCtx, cacheItems)
+	if mode.readsCache() {
+		cl.tracePhase(c, "nds.loadLocalCache", cacheItems,
+			func(c context.Context) error {
+				cl.loadLocalCache(c, cacheItems)
+				return nil
+			})
+	}
+
+	if !cl.cacheReadable(memcacheCtx) {
+		// The cache is unavailable or not yet consistent so don't use it.
+		for i := range cacheItems {
+			if cacheItems[i].state == miss {
+				cacheItems[i].state = externalLock
+			}
+		}
+	} else {
+		if mode.readsCache() {
+			cl.tracePhase(memcacheCtx, "nds.loadMemcache", cacheItems,
+				func(c context.Context) error {
+					cl.loadMemcache(c, cacheItems, mode)
+					return nil
+				})
+		} else if mode&ForceRefresh != 0 {
+			cl.tracePhase(memcacheCtx, "nds.refreshMemcache", cacheItems,
+				func(c context.Context) error {
+					cl.refreshMemcache(c, cacheItems)
+					return nil
+				})
+		}
 
-	lockMemcache(memcacheCtx, cacheItems)
+		if mode.writesCache() {
+			cl.tracePhase(memcacheCtx, "nds.lockMemcache", cacheItems,
+				func(c context.Context) error {
+					cl.lockMemcache(c, cacheItems, mode)
+					return nil
+				})
+		}
+	}
 
-	if err := loadDatastore(c, cacheItems, vals.Type()); err != nil {
+	switch {
+	case mode == CacheOnly:
+		for i := range cacheItems {
+			if cacheItems[i].state != done {
+				cacheItems[i].state = done
+				cacheItems[i].err = ErrCacheMiss
+			}
+		}
+	case !mode.writesCache():
+		for i := range cacheItems {
+			if cacheItems[i].state == miss {
+				cacheItems[i].state = bypass
+			}
+		}
+	}
+
+	if err := cl.tracePhase(c, "nds.loadDatastore", cacheItems,
+		func(c context.Context) error {
+			return cl.loadDatastore(c, cacheItems, vals.Type())
+		}); err != nil {
 		return err
 	}
 
-	saveMemcache(memcacheCtx, cacheItems)
+	cl.tracePhase(memcacheCtx, "nds.saveMemcache", cacheItems,
+		func(c context.Context) error {
+			cl.saveMemcache(c, cacheItems)
+			return nil
+		})
 
 	me, errsNil := make(datastore.MultiError, len(cacheItems)), true
 	for i, cacheItem := range cacheItems {
@@ -182,47 +290,185 @@ func getMulti(c context.Context,
 	return me
 }
 
-func loadMemcache(c context.Context, cacheItems []cacheItem) {
-
-	memcacheKeys := make([]string, len(cacheItems))
+// loadLocalCache sets the values of cacheItems found in the local cache.
+func (cl *Client) loadLocalCache(c context.Context, cacheItems []cacheItem) {
 	for i, cacheItem := range cacheItems {
-		memcacheKeys[i] = cacheItem.memcacheKey
+		if cacheItem.state == bypass {
+			continue
+		}
+		item, ok := cl.localCache.get(cacheItem.memcacheKey)
+		if !ok {
+			continue
+		}
+		switch item.Flags {
+		case noneItem:
+			cacheItems[i].state = done
+			cacheItems[i].err = datastore.ErrNoSuchEntity
+			cl.count(c, EventLocalCacheHit, cacheItem.key)
+		case entityItem:
+			pl := datastore.PropertyList{}
+			if err := cl.unmarshal(item.Value, &pl); err != nil {
+				cl.count(c, EventUnmarshalFailure, cacheItem.key)
+				cl.warn(c, "loadLocalCache", "unmarshal failed", err,
+					cacheItems[i].logArgs()...)
+				break
+			}
+			if err := setValue(cacheItems[i].val, pl); err == nil {
+				cacheItems[i].state = done
+				cl.count(c, EventLocalCacheHit, cacheItem.key)
+			} else {
+				cl.count(c, EventSetValueFailure, cacheItem.key)
+				cl.warn(c, "loadLocalCache", "setValue failed", err,
+					cacheItems[i].logArgs()...)
+			}
+		}
 	}
+}
+
+func (cl *Client) loadMemcache(c context.Context, cacheItems []cacheItem,
+	mode CacheMode) {
 
-	items, err := memcacheGetMulti(c, memcacheKeys)
+	memcacheKeys := make([]string, 0, len(cacheItems))
+	for _, cacheItem := range cacheItems {
+		if cacheItem.state == miss {
+			memcacheKeys = append(memcacheKeys, cacheItem.memcacheKey)
+		}
+	}
+
+	items, err := cl.memcacheGetMulti(c, memcacheKeys)
 	if err != nil {
 		for i := range cacheItems {
-			cacheItems[i].state = externalLock
+			if cacheItems[i].state == miss {
+				cacheItems[i].state = externalLock
+			}
 		}
-		log.Printf("WARNING: nds:loadMemcache GetMulti %s", err)
+		cl.warn(c, "loadMemcache", "cache GetMulti failed", err,
+			"keys", len(memcacheKeys))
 		return
 	}
+	cl.loadChunks(c, items)
 
-	for i, memcacheKey := range memcacheKeys {
-		if item, ok := items[memcacheKey]; ok {
+	for i, cacheItem := range cacheItems {
+		if cacheItem.state != miss {
+			continue
+		}
+		if item, ok := items[cacheItem.memcacheKey]; ok {
 			switch item.Flags {
 			case lockItem:
 				cacheItems[i].state = externalLock
+				cl.count(c, EventCacheHitLock, cacheItem.key)
+			case chunkedItem:
+				// Some chunks are gone so take the lock from the manifest
+				// and load the entity again.
+				if mode.writesCache() {
+					cacheItems[i].item = cl.relockChunked(c, item)
+				}
+				cl.count(c, EventCacheMiss, cacheItem.key)
 			case noneItem:
 				cacheItems[i].state = done
 				cacheItems[i].err = datastore.ErrNoSuchEntity
+				cl.localCache.set(item, cacheItem.localSnapshot,
+					cacheItem.policy.TTL)
+				cl.count(c, EventCacheHitNone, cacheItem.key)
 			case entityItem:
+				cl.count(c, EventCacheHitEntity, cacheItem.key)
 				pl := datastore.PropertyList{}
-				if err := unmarshal(item.Value, &pl); err != nil {
-					log.Printf("WARNING: nds:loadMemcache unmarshal %s", err)
+				if err := cl.unmarshal(item.Value, &pl); err != nil {
 					cacheItems[i].state = externalLock
+					cl.count(c, EventUnmarshalFailure, cacheItem.key)
+					cl.warn(c, "loadMemcache", "unmarshal failed", err,
+						cacheItems[i].logArgs()...)
 					break
 				}
 				if err := setValue(cacheItems[i].val, pl); err == nil {
 					cacheItems[i].state = done
+					cl.localCache.set(item, cacheItem.localSnapshot,
+						cacheItem.policy.TTL)
 				} else {
-					log.Printf("WARNING: nds:loadMemcache setValue %s", err)
 					cacheItems[i].state = externalLock
+					cl.count(c, EventSetValueFailure, cacheItem.key)
+					cl.warn(c, "loadMemcache", "setValue failed", err,
+						cacheItems[i].logArgs()...)
 				}
 			default:
-				log.Printf("WARNING: nds:loadMemcache unknown item.Flags %d", item.Flags)
 				cacheItems[i].state = externalLock
+				cl.warn(c, "loadMemcache", "unknown item flags", nil,
+					append(cacheItems[i].logArgs(), "flags", item.Flags)...)
 			}
+		} else {
+			cl.count(c, EventCacheMiss, cacheItem.key)
+		}
+	}
+}
+
+// refreshMemcache takes the locks of cached entities from their cache items,
+// so that they are loaded from the datastore and cached again. Entities that
+// are not cached are locked by lockMemcache as usual.
+func (cl *Client) refreshMemcache(c context.Context, cacheItems []cacheItem) {
+
+	memcacheKeys := make([]string, 0, len(cacheItems))
+	for _, cacheItem := range cacheItems {
+		if cacheItem.state == miss {
+			memcacheKeys = append(memcacheKeys, cacheItem.memcacheKey)
+		}
+	}
+	cl.localCache.delete(memcacheKeys)
+
+	items, err := cl.memcacheGetMulti(c, memcacheKeys)
+	if err != nil {
+		for i := range cacheItems {
+			if cacheItems[i].state == miss {
+				cacheItems[i].state = externalLock
+			}
+		}
+		cl.warn(c, "refreshMemcache", "cache GetMulti failed", err,
+			"keys", len(memcacheKeys))
+		return
+	}
+
+	locks := make([]*Item, 0, len(items))
+	lockIndex := make([]int, 0, len(items))
+	for i, cacheItem := range cacheItems {
+		if cacheItem.state != miss {
+			continue
+		}
+		item, ok := items[cacheItem.memcacheKey]
+		if !ok {
+			continue
+		}
+		if item.Flags == lockItem {
+			cacheItems[i].state = externalLock
+			cl.count(c, EventCacheHitLock, cacheItem.key)
+			continue
+		}
+		lock := &Item{
+			Key:        item.Key,
+			Flags:      lockItem,
+			Value:      itemLock(),
+			Expiration: memcacheLockTime,
+		}
+		lock.SetCASInfo(item.CASInfo())
+		locks = append(locks, lock)
+		lockIndex = append(lockIndex, i)
+	}
+	if len(locks) == 0 {
+		return
+	}
+
+	// An entity whose item changed since it was read is being written, so
+	// it is loaded without being cached.
+	err = cl.memcacheCompareAndSwapMulti(c, locks)
+	me, ok := err.(datastore.MultiError)
+	ok = ok && len(me) == len(locks)
+	if err != nil && !ok {
+		cl.warn(c, "refreshMemcache", "cache CompareAndSwapMulti failed", err,
+			"keys", len(locks))
+	}
+	for j, i := range lockIndex {
+		if err != nil && (!ok || me[j] != nil) {
+			cacheItems[i].state = externalLock
+		} else {
+			cacheItems[i].item = locks[j]
 		}
 	}
 }
@@ -243,14 +489,23 @@ func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 
-func lockMemcache(c context.Context, cacheItems []cacheItem) {
+// lockMemcache locks the cache items of the entities that missed the cache,
+// so that they can be cached once loaded. Unless mode reads the cache,
+// entities cached meanwhile are loaded from the datastore instead.
+func (cl *Client) lockMemcache(c context.Context, cacheItems []cacheItem,
+	mode CacheMode) {
 
-	lockItems := make([]*memcache.Item, 0, len(cacheItems))
+	lockItems := make([]*Item, 0, len(cacheItems))
 	lockMemcacheKeys := make([]string, 0, len(cacheItems))
 	for i, cacheItem := range cacheItems {
 		if cacheItem.state == miss {
+			lockMemcacheKeys = append(lockMemcacheKeys, cacheItem.memcacheKey)
 
-			item := &memcache.Item{
+			// loadMemcache may already hold the lock.
+			if cacheItem.item != nil {
+				continue
+			}
+			item := &Item{
 				Key:        cacheItem.memcacheKey,
 				Flags:      lockItem,
 				Value:      itemLock(),
@@ -258,17 +513,17 @@ func lockMemcache(c context.Context, cacheItems []cacheItem) {
 			}
 			cacheItems[i].item = item
 			lockItems = append(lockItems, item)
-			lockMemcacheKeys = append(lockMemcacheKeys, cacheItem.memcacheKey)
 		}
 	}
 
 	// We don't care if there are errors here.
-	if err := memcacheAddMulti(c, lockItems); err != nil {
-		log.Printf("WARNING: nds:lockMemcache AddMulti %s", err)
+	if err := cl.memcacheAddMulti(c, lockItems); err != nil {
+		cl.debug(c, "lockMemcache", "cache AddMulti failed", err,
+			"keys", len(lockItems))
 	}
 
 	// Get the items again so we can use CAS when updating the cache.
-	items, err := memcacheGetMulti(c, lockMemcacheKeys)
+	items, err := cl.memcacheGetMulti(c, lockMemcacheKeys)
 
 	// Cache failed so forget about it and just use the datastore.
 	if err != nil {
@@ -277,42 +532,63 @@ func lockMemcache(c context.Context, cacheItems []cacheItem) {
 				cacheItems[i].state = externalLock
 			}
 		}
-		log.Printf("WARNING: nds:lockMemcache GetMulti %s", err)
+		cl.warn(c, "lockMemcache", "cache GetMulti failed", err,
+			"keys", len(lockMemcacheKeys))
 		return
 	}
+	cl.loadChunks(c, items)
 
 	// Cache worked so figure out what items we got.
 	for i, cacheItem := range cacheItems {
 		if cacheItem.state == miss {
 			if item, ok := items[cacheItem.memcacheKey]; ok {
+				if !mode.readsCache() && item.Flags != lockItem {
+					// Cached meanwhile, but the caller wants it loaded from
+					// the datastore.
+					cacheItems[i].state = externalLock
+					continue
+				}
 				switch item.Flags {
 				case lockItem:
 					if bytes.Equal(item.Value, cacheItem.item.Value) {
 						cacheItems[i].item = item
 						cacheItems[i].state = internalLock
+						cl.count(c, EventInternalLock, cacheItem.key)
 					} else {
 						cacheItems[i].state = externalLock
+						cl.count(c, EventExternalLock, cacheItem.key)
 					}
 				case noneItem:
 					cacheItems[i].state = done
 					cacheItems[i].err = datastore.ErrNoSuchEntity
+					cl.localCache.set(item, cacheItem.localSnapshot,
+						cacheItem.policy.TTL)
 				case entityItem:
 					pl := datastore.PropertyList{}
-					if err := unmarshal(item.Value, &pl); err != nil {
-						log.Printf("WARNING: nds:lockMemcache unmarshal %s", err)
+					if err := cl.unmarshal(item.Value, &pl); err != nil {
 						cacheItems[i].state = externalLock
+						cl.count(c, EventUnmarshalFailure, cacheItem.key)
+						cl.warn(c, "lockMemcache", "unmarshal failed", err,
+							cacheItems[i].logArgs()...)
 						break
 					}
 					if err := setValue(cacheItems[i].val, pl); err == nil {
 						cacheItems[i].state = done
+						cl.localCache.set(item, cacheItem.localSnapshot,
+							cacheItem.policy.TTL)
 					} else {
-						log.Printf("WARNING: nds:lockMemcache setValue %s", err)
 						cacheItems[i].state = externalLock
+						cl.count(c, EventSetValueFailure, cacheItem.key)
+						cl.warn(c, "lockMemcache", "setValue failed", err,
+							cacheItems[i].logArgs()...)
 					}
+				case chunkedItem:
+					// A chunk went missing since loadMemcache ran.
+					cacheItems[i].state = externalLock
 				default:
-					log.Printf("WARNING: nds:lockMemcache unknown item.Flags %d",
-						item.Flags)
 					cacheItems[i].state = externalLock
+					cl.warn(c, "lockMemcache", "unknown item flags", nil,
+						append(cacheItems[i].logArgs(), "flags", item.Flags)...)
 				}
 			} else {
 				// We just added a memcache item but it now isn't available so
@@ -323,75 +599,235 @@ func lockMemcache(c context.Context, cacheItems []cacheItem) {
 	}
 }
 
-func loadDatastore(c context.Context, cacheItems []cacheItem,
+func (cl *Client) loadDatastore(c context.Context, cacheItems []cacheItem,
 	valsType reflect.Type) error {
 
 	keys := make([]*datastore.Key, 0, len(cacheItems))
 	vals := make([]datastore.PropertyList, 0, len(cacheItems))
 	cacheItemsIndex := make([]int, 0, len(cacheItems))
 
+	// With coalesced loads each item either leads a flight, reading the
+	// entity for every call waiting on it, or follows the flight of another
+	// call.
+	leading := make([]*flight, 0, len(cacheItems))
+	following := map[int]*flight{}
+
 	for i, cacheItem := range cacheItems {
 		switch cacheItem.state {
-		case internalLock, externalLock:
+		case externalLock:
+			cl.count(c, EventDatastoreFallback, cacheItem.key)
+			if cl.flights != nil {
+				f, leader := cl.flights.join(cacheItem.memcacheKey,
+					cacheItem.flightSnapshot)
+				if !leader {
+					following[i] = f
+					continue
+				}
+				leading = append(leading, f)
+			}
+			keys = append(keys, cacheItem.key)
+			vals = append(vals, datastore.PropertyList{})
+			cacheItemsIndex = append(cacheItemsIndex, i)
+		case internalLock, bypass:
+			// Items that bypass the cache are read fresh, so they never
+			// follow a flight, but calls that can share the read may follow
+			// theirs.
+			if cl.flights != nil {
+				leading = append(leading,
+					cl.flights.start(cacheItem.memcacheKey))
+			}
 			keys = append(keys, cacheItem.key)
 			vals = append(vals, datastore.PropertyList{})
 			cacheItemsIndex = append(cacheItemsIndex, i)
 		}
 	}
 
-	var me datastore.MultiError
-	if err := datastoreGetMulti(c, keys, vals); err == nil {
-		me = make(datastore.MultiError, len(keys))
-	} else if e, ok := err.(datastore.MultiError); ok {
-		me = e
-	} else {
+	me, err := cl.loadDatastoreKeys(c, keys, vals)
+	for i, f := range leading {
+		index := cacheItemsIndex[i]
+		if err != nil {
+			cl.flights.land(cacheItems[index].memcacheKey, f, nil, err)
+		} else {
+			cl.flights.land(cacheItems[index].memcacheKey, f, vals[i], me[i])
+		}
+	}
+	if err != nil {
 		return err
 	}
+	for i, index := range cacheItemsIndex {
+		cl.setDatastoreResult(c, &cacheItems[index], vals[i], me[i])
+	}
 
+	// Items whose flight failed are read again as the failure may have been
+	// down to the context of the call that led it.
+	keys, vals, cacheItemsIndex = keys[:0], vals[:0], cacheItemsIndex[:0]
+	for index, f := range following {
+		select {
+		case <-f.done:
+		case <-c.Done():
+			return c.Err()
+		}
+		pl, err := f.result()
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			keys = append(keys, cacheItems[index].key)
+			vals = append(vals, datastore.PropertyList{})
+			cacheItemsIndex = append(cacheItemsIndex, index)
+			continue
+		}
+		cl.count(c, EventCoalescedLoad, cacheItems[index].key)
+		cl.setDatastoreResult(c, &cacheItems[index], pl, err)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	me, err = cl.loadDatastoreKeys(c, keys, vals)
+	if err != nil {
+		return err
+	}
 	for i, index := range cacheItemsIndex {
-		switch me[i] {
-		case nil:
-			pl := vals[i]
-			val := cacheItems[index].val
-			if err := setValue(val, pl); err != nil {
-				cacheItems[index].err = err
-			}
+		cl.setDatastoreResult(c, &cacheItems[index], vals[i], me[i])
+	}
+	return nil
+}
 
-			if cacheItems[index].state == internalLock {
-				cacheItems[index].item.Flags = entityItem
-				cacheItems[index].item.Expiration = 0
-				if data, err := marshal(pl); err == nil {
-					cacheItems[index].item.Value = data
-				} else {
-					cacheItems[index].state = externalLock
-					log.Printf("WARNING: nds:loadDatastore marshal %s", err)
+// loadDatastoreKeys reads keys into vals and returns the error of each key.
+// The returned error is set if the whole call failed.
+func (cl *Client) loadDatastoreKeys(c context.Context, keys []*datastore.Key,
+	vals []datastore.PropertyList) (datastore.MultiError, error) {
+
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	if err := cl.datastoreGetMulti(c, keys, vals); err == nil {
+		return make(datastore.MultiError, len(keys)), nil
+	} else if me, ok := err.(datastore.MultiError); ok {
+		return me, nil
+	} else {
+		return nil, err
+	}
+}
+
+// setDatastoreResult loads the entity read for cacheItem, or err, into it
+// and prepares the item to cache if cacheItem holds the lock.
+func (cl *Client) setDatastoreResult(c context.Context, cacheItem *cacheItem,
+	pl datastore.PropertyList, err error) {
+
+	switch err {
+	case nil:
+		if err := setValue(cacheItem.val, pl); err != nil {
+			cacheItem.err = err
+		}
+
+		if cacheItem.state == internalLock {
+			policy := cacheItem.policy
+			cacheItem.item.Flags = entityItem
+			cacheItem.item.Expiration = policy.TTL
+			if data, err := cl.marshal(pl); err != nil {
+				cacheItem.state = externalLock
+				cl.warn(c, "loadDatastore", "marshal failed", err,
+					cacheItem.logArgs()...)
+			} else if policy.MaxItemSize > 0 &&
+				len(data) > policy.MaxItemSize {
+				// Too large to cache. The lock is left to expire.
+				cacheItem.state = externalLock
+			} else {
+				cacheItem.item.Value = data
+				if len(data) > cl.maxItemSize {
+					cacheItem.item.Flags = chunkedItem
+					cacheItem.item.Value, cacheItem.chunks =
+						splitChunks(cacheItem.memcacheKey, data,
+							cl.maxItemSize)
+					cacheItem.item.Expiration =
+						chunkedExpiration(policy.TTL)
+					for _, chunk := range cacheItem.chunks {
+						chunk.Expiration = cacheItem.item.Expiration
+					}
 				}
 			}
-		case datastore.ErrNoSuchEntity:
-			if cacheItems[index].state == internalLock {
-				cacheItems[index].item.Flags = noneItem
-				cacheItems[index].item.Expiration = 0
-				cacheItems[index].item.Value = []byte{}
+		}
+	case datastore.ErrNoSuchEntity:
+		if cacheItem.state == internalLock {
+			if cacheItem.policy.NoNegativeCache {
+				// The lock is left to expire.
+				cacheItem.state = externalLock
+			} else {
+				cacheItem.item.Flags = noneItem
+				cacheItem.item.Expiration = cacheItem.policy.TTL
+				cacheItem.item.Value = []byte{}
 			}
-			cacheItems[index].err = datastore.ErrNoSuchEntity
-		default:
-			cacheItems[index].state = externalLock
-			cacheItems[index].err = me[i]
 		}
+		cacheItem.err = datastore.ErrNoSuchEntity
+	default:
+		cacheItem.state = externalLock
+		cacheItem.err = err
 	}
-	return nil
 }
 
-func saveMemcache(c context.Context, cacheItems []cacheItem) {
+func (cl *Client) saveMemcache(c context.Context, cacheItems []cacheItem) {
 
-	saveItems := make([]*memcache.Item, 0, len(cacheItems))
+	chunks := []*Item{}
 	for _, cacheItem := range cacheItems {
 		if cacheItem.state == internalLock {
+			chunks = append(chunks, cacheItem.chunks...)
+		}
+	}
+
+	// Chunks go in first so that a manifest is never seen without them. If
+	// they can't be stored the manifests are not saved and the locks expire.
+	chunksSaved := true
+	if len(chunks) > 0 {
+		if err := cl.memcacheSetMulti(c, chunks); err != nil {
+			cl.warn(c, "saveMemcache", "cache SetMulti of chunks failed", err,
+				"keys", len(chunks))
+			chunksSaved = false
+		}
+	}
+
+	saveItems := make([]*Item, 0, len(cacheItems))
+	saveCacheItems := make([]cacheItem, 0, len(cacheItems))
+	for _, cacheItem := range cacheItems {
+		if cacheItem.state == internalLock &&
+			(chunksSaved || len(cacheItem.chunks) == 0) {
 			saveItems = append(saveItems, cacheItem.item)
+			saveCacheItems = append(saveCacheItems, cacheItem)
 		}
 	}
 
-	if err := memcacheCompareAndSwapMulti(c, saveItems); err != nil {
-		log.Printf("WARNING: nds:saveMemcache CompareAndSwapMulti %s", err)
+	if len(saveItems) == 0 {
+		return
+	}
+	err := cl.memcacheCompareAndSwapMulti(c, saveItems)
+
+	// Only items that made it into the cache can be cached locally. The
+	// chunks of manifests that didn't are no longer needed.
+	me, ok := err.(datastore.MultiError)
+	if err != nil && (!ok || len(me) != len(saveItems)) {
+		cl.warn(c, "saveMemcache", "cache CompareAndSwapMulti failed", err,
+			"keys", len(saveItems))
+		for _, cacheItem := range saveCacheItems {
+			cl.count(c, EventCASFailure, cacheItem.key)
+		}
+		cl.deleteChunks(c, saveCacheItems)
+		return
+	}
+	orphans := []cacheItem{}
+	for i, cacheItem := range saveCacheItems {
+		if me != nil && me[i] != nil {
+			// Usually a concurrent put or delete took the lock.
+			cl.count(c, EventCASFailure, cacheItem.key)
+			cl.debug(c, "saveMemcache", "cache CompareAndSwap failed", me[i],
+				cacheItem.logArgs()...)
+			orphans = append(orphans, cacheItem)
+		} else if len(cacheItem.chunks) > 0 {
+			cl.localCache.set(&Item{
+				Key:   cacheItem.memcacheKey,
+				Flags: entityItem,
+				Value: joinChunks(cacheItem.chunks),
+			}, cacheItem.localSnapshot, cacheItem.policy.TTL)
+		} else {
+			cl.localCache.set(cacheItem.item, cacheItem.localSnapshot,
+				cacheItem.policy.TTL)
+		}
 	}
+	cl.deleteChunks(c, orphans)
 }
@@ -11,7 +11,6 @@ import (
 
 	"golang.org/x/net/context"
 	"cloud.google.com/go/datastore"
-	"github.com/bradfitz/gomemcache/memcache"
 )
 
 func TestGetMultiStruct(t *testing.T) {
@@ -266,7 +265,7 @@ func TestGetMultiPropertyLoadSaver(t *testing.T) {
 		return nil
 	})
 	defer func() {
-		nds.SetDatastoreGetMulti(nds.DsClient.GetMulti)
+		nds.SetDatastoreGetMulti(nds.DsClient().GetMulti)
 	}()
 	tes := make([]testEntity, len(entities))
 	if err := nds.GetMulti(c, keys, tes); err != nil {
@@ -495,11 +494,11 @@ func TestGetMultiLockReturnEntitySetValueFail(t *testing.T) {
 
 	// Fail to unmarshal test.
 	memcacheGetChan := make(chan func(c context.Context, keys []string) (
-		map[string]*memcache.Item, error), 2)
-	memcacheGetChan <- nds.McClient.GetMulti
+		map[string]*nds.Item, error), 2)
+	memcacheGetChan <- nds.McClient().GetMulti
 	memcacheGetChan <- func(c context.Context,
-		keys []string) (map[string]*memcache.Item, error) {
-		items, err := nds.McClient.GetMulti(c, keys)
+		keys []string) (map[string]*nds.Item, error) {
+		items, err := nds.McClient().GetMulti(c, keys)
 		if err != nil {
 			return nil, err
 		}
@@ -517,7 +516,7 @@ func TestGetMultiLockReturnEntitySetValueFail(t *testing.T) {
 		return items, nil
 	}
 	nds.SetMemcacheGetMulti(func(c context.Context,
-		keys []string) (map[string]*memcache.Item, error) {
+		keys []string) (map[string]*nds.Item, error) {
 		f := <-memcacheGetChan
 		return f(c, keys)
 	})
@@ -526,7 +525,7 @@ func TestGetMultiLockReturnEntitySetValueFail(t *testing.T) {
 	if err := nds.GetMulti(c, keys, response); err != nil {
 		t.Fatal(err)
 	}
-	defer nds.SetMemcacheGetMulti(nds.McClient.GetMulti)
+	defer nds.SetMemcacheGetMulti(nds.McClient().GetMulti)
 
 	for i := 0; i < len(keys); i++ {
 		if entities[i].IntVal != response[i].IntVal {
@@ -555,11 +554,11 @@ func TestGetMultiLockReturnEntity(t *testing.T) {
 	}
 
 	memcacheGetChan := make(chan func(c context.Context, keys []string) (
-		map[string]*memcache.Item, error), 2)
-	memcacheGetChan <- nds.McClient.GetMulti
+		map[string]*nds.Item, error), 2)
+	memcacheGetChan <- nds.McClient().GetMulti
 	memcacheGetChan <- func(c context.Context,
-		keys []string) (map[string]*memcache.Item, error) {
-		items, err := nds.McClient.GetMulti(c, keys)
+		keys []string) (map[string]*nds.Item, error) {
+		items, err := nds.McClient().GetMulti(c, keys)
 		if err != nil {
 			return nil, err
 		}
@@ -577,7 +576,7 @@ func TestGetMultiLockReturnEntity(t *testing.T) {
 		return items, nil
 	}
 	nds.SetMemcacheGetMulti(func(c context.Context,
-		keys []string) (map[string]*memcache.Item, error) {
+		keys []string) (map[string]*nds.Item, error) {
 		f := <-memcacheGetChan
 		return f(c, keys)
 	})
@@ -586,7 +585,7 @@ func TestGetMultiLockReturnEntity(t *testing.T) {
 	if err := nds.GetMulti(c, keys, response); err != nil {
 		t.Fatal(err)
 	}
-	defer nds.SetMemcacheGetMulti(nds.McClient.GetMulti)
+	defer nds.SetMemcacheGetMulti(nds.McClient().GetMulti)
 
 	for i := 0; i < len(keys); i++ {
 		if 5 != response[i].IntVal {
@@ -615,11 +614,11 @@ func TestGetMultiLockReturnUnknown(t *testing.T) {
 	}
 
 	memcacheGetChan := make(chan func(c context.Context, keys []string) (
-		map[string]*memcache.Item, error), 2)
-	memcacheGetChan <- nds.McClient.GetMulti
+		map[string]*nds.Item, error), 2)
+	memcacheGetChan <- nds.McClient().GetMulti
 	memcacheGetChan <- func(c context.Context,
-		keys []string) (map[string]*memcache.Item, error) {
-		items, err := nds.McClient.GetMulti(c, keys)
+		keys []string) (map[string]*nds.Item, error) {
+		items, err := nds.McClient().GetMulti(c, keys)
 		if err != nil {
 			return nil, err
 		}
@@ -630,7 +629,7 @@ func TestGetMultiLockReturnUnknown(t *testing.T) {
 		return items, nil
 	}
 	nds.SetMemcacheGetMulti(func(c context.Context,
-		keys []string) (map[string]*memcache.Item, error) {
+		keys []string) (map[string]*nds.Item, error) {
 		f := <-memcacheGetChan
 		return f(c, keys)
 	})
@@ -639,7 +638,7 @@ func TestGetMultiLockReturnUnknown(t *testing.T) {
 	if err := nds.GetMulti(c, keys, response); err != nil {
 		t.Fatal(err)
 	}
-	defer nds.SetMemcacheGetMulti(nds.McClient.GetMulti)
+	defer nds.SetMemcacheGetMulti(nds.McClient().GetMulti)
 
 	for i := 0; i < len(keys); i++ {
 		if entities[i].IntVal != response[i].IntVal {
@@ -668,11 +667,11 @@ func TestGetMultiLockReturnMiss(t *testing.T) {
 	}
 
 	memcacheGetChan := make(chan func(c context.Context, keys []string) (
-		map[string]*memcache.Item, error), 2)
-	memcacheGetChan <- nds.McClient.GetMulti
+		map[string]*nds.Item, error), 2)
+	memcacheGetChan <- nds.McClient().GetMulti
 	memcacheGetChan <- func(c context.Context,
-		keys []string) (map[string]*memcache.Item, error) {
-		items, err := nds.McClient.GetMulti(c, keys)
+		keys []string) (map[string]*nds.Item, error) {
+		items, err := nds.McClient().GetMulti(c, keys)
 		if err != nil {
 			return nil, err
 		}
@@ -682,7 +681,7 @@ func TestGetMultiLockReturnMiss(t *testing.T) {
 		return items, nil
 	}
 	nds.SetMemcacheGetMulti(func(c context.Context,
-		keys []string) (map[string]*memcache.Item, error) {
+		keys []string) (map[string]*nds.Item, error) {
 		f := <-memcacheGetChan
 		return f(c, keys)
 	})
@@ -691,7 +690,7 @@ func TestGetMultiLockReturnMiss(t *testing.T) {
 	if err := nds.GetMulti(c, keys, response); err != nil {
 		t.Fatal(err)
 	}
-	defer nds.SetMemcacheGetMulti(nds.McClient.GetMulti)
+	defer nds.SetMemcacheGetMulti(nds.McClient().GetMulti)
 
 	for i := 0; i < len(keys); i++ {
 		if entities[i].IntVal != response[i].IntVal {
@@ -704,23 +703,23 @@ func TestGetMultiPaths(t *testing.T) {
 	expectedErr := errors.New("expected error")
 
 	type memcacheGetMultiFunc func(c context.Context,
-		keys []string) (map[string]*memcache.Item, error)
+		keys []string) (map[string]*nds.Item, error)
 	memcacheGetMultiFail := func(c context.Context,
-		keys []string) (map[string]*memcache.Item, error) {
+		keys []string) (map[string]*nds.Item, error) {
 		return nil, expectedErr
 	}
 
 	type memcacheAddMultiFunc func(c context.Context,
-		items []*memcache.Item) error
+		items []*nds.Item) error
 	memcacheAddMultiFail := func(c context.Context,
-		items []*memcache.Item) error {
+		items []*nds.Item) error {
 		return expectedErr
 	}
 
 	type memcacheCompareAndSwapMultiFunc func(c context.Context,
-		items []*memcache.Item) error
+		items []*nds.Item) error
 	memcacheCompareAndSwapMultiFail := func(c context.Context,
-		items []*memcache.Item) error {
+		items []*nds.Item) error {
 		return expectedErr
 	}
 
@@ -788,12 +787,12 @@ func TestGetMultiPaths(t *testing.T) {
 			20,
 			1,
 			[]memcacheGetMultiFunc{
-				nds.McClient.GetMulti,
-				nds.McClient.GetMulti,
+				nds.McClient().GetMulti,
+				nds.McClient().GetMulti,
 			},
-			nds.McClient.AddMulti,
-			nds.McClient.CompareAndSwapMulti,
-			nds.DsClient.GetMulti,
+			nds.McClient().AddMulti,
+			nds.McClient().CompareAndSwapMulti,
+			nds.DsClient().GetMulti,
 			nds.MarshalPropertyList,
 			[]unmarshalFunc{
 				nds.UnmarshalPropertyList,
@@ -806,11 +805,11 @@ func TestGetMultiPaths(t *testing.T) {
 			2,
 			1,
 			[]memcacheGetMultiFunc{
-				nds.McClient.GetMulti,
-				nds.McClient.GetMulti,
+				nds.McClient().GetMulti,
+				nds.McClient().GetMulti,
 			},
-			nds.McClient.AddMulti,
-			nds.McClient.CompareAndSwapMulti,
+			nds.McClient().AddMulti,
+			nds.McClient().CompareAndSwapMulti,
 			datastoreGetMultiFail,
 			nds.MarshalPropertyList,
 			[]unmarshalFunc{
@@ -824,11 +823,11 @@ func TestGetMultiPaths(t *testing.T) {
 			2,
 			1,
 			[]memcacheGetMultiFunc{
-				nds.McClient.GetMulti,
-				nds.McClient.GetMulti,
+				nds.McClient().GetMulti,
+				nds.McClient().GetMulti,
 			},
-			nds.McClient.AddMulti,
-			nds.McClient.CompareAndSwapMulti,
+			nds.McClient().AddMulti,
+			nds.McClient().CompareAndSwapMulti,
 			func(c context.Context,
 				keys []*datastore.Key, vals interface{}) error {
 
@@ -852,12 +851,12 @@ func TestGetMultiPaths(t *testing.T) {
 			5,
 			1,
 			[]memcacheGetMultiFunc{
-				nds.McClient.GetMulti,
-				nds.McClient.GetMulti,
+				nds.McClient().GetMulti,
+				nds.McClient().GetMulti,
 			},
-			nds.McClient.AddMulti,
-			nds.McClient.CompareAndSwapMulti,
-			nds.DsClient.GetMulti,
+			nds.McClient().AddMulti,
+			nds.McClient().CompareAndSwapMulti,
+			nds.DsClient().GetMulti,
 			marshalFail,
 			[]unmarshalFunc{
 				nds.UnmarshalPropertyList,
@@ -875,7 +874,7 @@ func TestGetMultiPaths(t *testing.T) {
 			},
 			memcacheAddMultiFail,
 			memcacheCompareAndSwapMultiFail,
-			nds.DsClient.GetMulti,
+			nds.DsClient().GetMulti,
 			nds.MarshalPropertyList,
 			[]unmarshalFunc{
 				nds.UnmarshalPropertyList,
@@ -888,12 +887,12 @@ func TestGetMultiPaths(t *testing.T) {
 			20,
 			1,
 			[]memcacheGetMultiFunc{
-				nds.McClient.GetMulti,
+				nds.McClient().GetMulti,
 				memcacheGetMultiFail,
 			},
-			nds.McClient.AddMulti,
-			nds.McClient.CompareAndSwapMulti,
-			nds.DsClient.GetMulti,
+			nds.McClient().AddMulti,
+			nds.McClient().CompareAndSwapMulti,
+			nds.DsClient().GetMulti,
 			nds.MarshalPropertyList,
 			[]unmarshalFunc{
 				nds.UnmarshalPropertyList,
@@ -907,23 +906,23 @@ func TestGetMultiPaths(t *testing.T) {
 			2,
 			[]memcacheGetMultiFunc{
 				// Charge nds.McClient.
-				nds.McClient.GetMulti,
-				nds.McClient.GetMulti,
+				nds.McClient().GetMulti,
+				nds.McClient().GetMulti,
 				// Corrupt nds.McClient.
 				func(c context.Context, keys []string) (
-					map[string]*memcache.Item, error) {
-					items, err := nds.McClient.GetMulti(c, keys)
+					map[string]*nds.Item, error) {
+					items, err := nds.McClient().GetMulti(c, keys)
 					// Corrupt items.
 					for _, item := range items {
 						item.Value = []byte("corrupt string")
 					}
 					return items, err
 				},
-				nds.McClient.GetMulti,
+				nds.McClient().GetMulti,
 			},
-			nds.McClient.AddMulti,
-			nds.McClient.CompareAndSwapMulti,
-			nds.DsClient.GetMulti,
+			nds.McClient().AddMulti,
+			nds.McClient().CompareAndSwapMulti,
+			nds.DsClient().GetMulti,
 			nds.MarshalPropertyList,
 			[]unmarshalFunc{
 				nds.UnmarshalPropertyList,
@@ -939,23 +938,23 @@ func TestGetMultiPaths(t *testing.T) {
 			2,
 			[]memcacheGetMultiFunc{
 				// Charge nds.McClient.
-				nds.McClient.GetMulti,
-				nds.McClient.GetMulti,
+				nds.McClient().GetMulti,
+				nds.McClient().GetMulti,
 				// Corrupt memcache flags.
 				func(c context.Context, keys []string) (
-					map[string]*memcache.Item, error) {
-					items, err := nds.McClient.GetMulti(c, keys)
+					map[string]*nds.Item, error) {
+					items, err := nds.McClient().GetMulti(c, keys)
 					// Corrupt flags with unknown number.
 					for _, item := range items {
 						item.Flags = 56
 					}
 					return items, err
 				},
-				nds.McClient.GetMulti,
+				nds.McClient().GetMulti,
 			},
-			nds.McClient.AddMulti,
-			nds.McClient.CompareAndSwapMulti,
-			nds.DsClient.GetMulti,
+			nds.McClient().AddMulti,
+			nds.McClient().CompareAndSwapMulti,
+			nds.DsClient().GetMulti,
 			nds.MarshalPropertyList,
 			[]unmarshalFunc{
 				nds.UnmarshalPropertyList,
@@ -970,10 +969,10 @@ func TestGetMultiPaths(t *testing.T) {
 			20,
 			1,
 			[]memcacheGetMultiFunc{
-				nds.McClient.GetMulti,
+				nds.McClient().GetMulti,
 				func(c context.Context, keys []string) (
-					map[string]*memcache.Item, error) {
-					items, err := nds.McClient.GetMulti(c, keys)
+					map[string]*nds.Item, error) {
+					items, err := nds.McClient().GetMulti(c, keys)
 					// Corrupt flags with unknown number.
 					for _, item := range items {
 						item.Value = []byte("corrupt value")
@@ -981,9 +980,9 @@ func TestGetMultiPaths(t *testing.T) {
 					return items, err
 				},
 			},
-			nds.McClient.AddMulti,
-			nds.McClient.CompareAndSwapMulti,
-			nds.DsClient.GetMulti,
+			nds.McClient().AddMulti,
+			nds.McClient().CompareAndSwapMulti,
+			nds.DsClient().GetMulti,
 			nds.MarshalPropertyList,
 			[]unmarshalFunc{
 				nds.UnmarshalPropertyList,
@@ -996,10 +995,10 @@ func TestGetMultiPaths(t *testing.T) {
 			2,
 			1,
 			[]memcacheGetMultiFunc{
-				nds.McClient.GetMulti,
+				nds.McClient().GetMulti,
 				func(c context.Context, keys []string) (
-					map[string]*memcache.Item, error) {
-					items, err := nds.McClient.GetMulti(c, keys)
+					map[string]*nds.Item, error) {
+					items, err := nds.McClient().GetMulti(c, keys)
 					// Corrupt flags with unknown number.
 					for _, item := range items {
 						item.Flags = nds.NoneItem
@@ -1007,9 +1006,9 @@ func TestGetMultiPaths(t *testing.T) {
 					return items, err
 				},
 			},
-			nds.McClient.AddMulti,
-			nds.McClient.CompareAndSwapMulti,
-			nds.DsClient.GetMulti,
+			nds.McClient().AddMulti,
+			nds.McClient().CompareAndSwapMulti,
+			nds.DsClient().GetMulti,
 			nds.MarshalPropertyList,
 			[]unmarshalFunc{
 				nds.UnmarshalPropertyList,
@@ -1027,10 +1026,10 @@ func TestGetMultiPaths(t *testing.T) {
 			2,
 			1,
 			[]memcacheGetMultiFunc{
-				nds.McClient.GetMulti,
+				nds.McClient().GetMulti,
 				func(c context.Context, keys []string) (
-					map[string]*memcache.Item, error) {
-					items, err := nds.McClient.GetMulti(c, keys)
+					map[string]*nds.Item, error) {
+					items, err := nds.McClient().GetMulti(c, keys)
 					// Corrupt flags with unknown number.
 					for _, item := range items {
 						item.Flags = nds.EntityItem
@@ -1038,9 +1037,9 @@ func TestGetMultiPaths(t *testing.T) {
 					return items, err
 				},
 			},
-			nds.McClient.AddMulti,
-			nds.McClient.CompareAndSwapMulti,
-			nds.DsClient.GetMulti,
+			nds.McClient().AddMulti,
+			nds.McClient().CompareAndSwapMulti,
+			nds.DsClient().GetMulti,
 			nds.MarshalPropertyList,
 			[]unmarshalFunc{
 				nds.UnmarshalPropertyList,
@@ -1066,7 +1065,7 @@ func TestGetMultiPaths(t *testing.T) {
 		}
 
 		nds.SetMemcacheGetMulti(func(c context.Context, keys []string) (
-			map[string]*memcache.Item, error) {
+			map[string]*nds.Item, error) {
 			fn := <-memcacheGetChan
 			return fn(c, keys)
 		})
@@ -1139,10 +1138,10 @@ func TestGetMultiPaths(t *testing.T) {
 		}
 
 		// Reset App Engine API calls.
-		nds.SetMemcacheGetMulti(nds.McClient.GetMulti)
-		nds.SetMemcacheAddMulti(nds.McClient.AddMulti)
-		nds.SetMemcacheCompareAndSwapMulti(nds.McClient.CompareAndSwapMulti)
-		nds.SetDatastoreGetMulti(nds.DsClient.GetMulti)
+		nds.SetMemcacheGetMulti(nds.McClient().GetMulti)
+		nds.SetMemcacheAddMulti(nds.McClient().AddMulti)
+		nds.SetMemcacheCompareAndSwapMulti(nds.McClient().CompareAndSwapMulti)
+		nds.SetDatastoreGetMulti(nds.DsClient().GetMulti)
 		nds.SetMarshal(nds.MarshalPropertyList)
 		nds.SetUnmarshal(nds.UnmarshalPropertyList)
 
@@ -1247,7 +1246,7 @@ func TestGetMultiFieldMismatch(t *testing.T) {
 
 	// Get from datastore using google api
 	dsResponse := make([]testEntityLean, len(keys))
-	dsErr := nds.DsClient.GetMulti(c, keys, dsResponse)
+	dsErr := nds.DsClient().GetMulti(c, keys, dsResponse)
 
 	if ndsErr.Error() != dsErr.Error() {
 		t.Fatal("Errors are not equal")
@@ -0,0 +1,69 @@
+package nds
+
+import (
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/net/context"
+)
+
+// InvalidateMulti calls Client.InvalidateMulti on the default client.
+func InvalidateMulti(c context.Context, keys []*datastore.Key) error {
+	return getDefaultClient().InvalidateMulti(c, keys)
+}
+
+// Invalidate calls Client.Invalidate on the default client.
+func Invalidate(c context.Context, keys ...*datastore.Key) error {
+	return getDefaultClient().Invalidate(c, keys...)
+}
+
+// InvalidateMulti drops the cached copies of the entities of keys after they
+// were written without nds, such as through the datastore package or by
+// another service. The entities are locked in the cache as a delete would
+// lock them, so gets in progress don't cache what they read before the
+// write, and they are cached again once the locks expire. Cached queries of
+// their kinds are invalidated too.
+//
+// Call it once the writes are done. Gets can serve the old entities until
+// then.
+func (cl *Client) InvalidateMulti(c context.Context,
+	keys []*datastore.Key) (err error) {
+	defer cl.observeLatency(c, "InvalidateMulti", keysKind(keys), time.Now())
+	c, span := cl.startSpan(c, "nds.InvalidateMulti",
+		attribute.Int("nds.keys", len(keys)))
+	defer func() { endSpan(span, err) }()
+
+	lockMemcacheKeys := make([]string, 0, len(keys))
+	lockMemcacheItems := make([]*Item, 0, len(keys))
+	for _, key := range keys {
+		if key == nil || key.Incomplete() {
+			return datastore.ErrInvalidKey
+		}
+		if cl.writePolicy(key.Kind).NoCache {
+			continue
+		}
+		item := &Item{
+			Key:        createMemcacheKey(key),
+			Flags:      lockItem,
+			Value:      itemLock(),
+			Expiration: memcacheLockTime,
+		}
+		lockMemcacheItems = append(lockMemcacheItems, item)
+		lockMemcacheKeys = append(lockMemcacheKeys, item.Key)
+	}
+
+	memcacheCtx, err := memcacheContext(c)
+	if err != nil {
+		return err
+	}
+
+	cl.localCache.delete(lockMemcacheKeys)
+	cl.flights.forget(lockMemcacheKeys)
+	return cl.lockCache(memcacheCtx, lockMemcacheItems, keys)
+}
+
+// Invalidate is the variadic form of InvalidateMulti.
+func (cl *Client) Invalidate(c context.Context, keys ...*datastore.Key) error {
+	return cl.InvalidateMulti(c, keys)
+}
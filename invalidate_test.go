@@ -0,0 +1,73 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/yoavfeld/nds"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestClientInvalidate(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	cache := newMemoryCache()
+	cl, err := nds.NewClient(nds.DsClient(), nds.WithCache(cache))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cl.Invalidate(c, nil); err != datastore.ErrInvalidKey {
+		t.Fatal("expected ErrInvalidKey", err)
+	}
+
+	keys := []*datastore.Key{
+		datastore.IDKey("InvalidateEntity", 1, nil),
+		datastore.IDKey("InvalidateEntity", 2, nil),
+	}
+	if _, err := cl.PutMulti(c, keys,
+		[]testEntity{{1}, {1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.GetMulti(c, keys, make([]testEntity, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Write behind nds' back, which leaves stale cached copies.
+	if _, err := nds.DsClient().PutMulti(c, keys,
+		[]testEntity{{2}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+	entities := make([]testEntity, 2)
+	if err := cl.GetMulti(c, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+	if entities[0].Val != 1 {
+		t.Fatal("expected the cached entity", entities[0].Val)
+	}
+
+	if err := cl.Invalidate(c, keys...); err != nil {
+		t.Fatal(err)
+	}
+	entities = make([]testEntity, 2)
+	if err := cl.GetMulti(c, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+	for _, entity := range entities {
+		if entity.Val != 2 {
+			t.Fatal("expected the written entity", entity.Val)
+		}
+	}
+
+	cache.Lock()
+	item := cache.items[nds.CreateMemcacheKey(keys[0])]
+	cache.Unlock()
+	if item.Flags != nds.LockItem {
+		t.Fatal("expected the entity to be locked", item.Flags)
+	}
+}
@@ -0,0 +1,224 @@
+package nds
+
+import (
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"golang.org/x/net/context"
+)
+
+const (
+	// journalPollInterval is how often a Client checks the journal for
+	// writes other processes made while the cache was unavailable to them.
+	journalPollInterval = 10 * time.Second
+
+	// journalRetryInterval is how often a Client that knows the journal is
+	// not empty tries to replay it.
+	journalRetryInterval = time.Second
+
+	// journalReplayBatch is the number of journal entries replayed at once.
+	journalReplayBatch = 500
+)
+
+// WithDegradedWrites lets puts and deletes go ahead when the cache can't be
+// locked, instead of failing. The cache keys of such writes are recorded
+// first in a journal stored in the datastore as entities of journalKind. The
+// journal is replayed by locking those keys in the cache, which keeps them
+// from being cached until the writes are done, and the Client doesn't read
+// the cache until it has replayed its own journaled writes.
+//
+// Every Client using the cache should use the same journalKind. Clients
+// check the journal every 10 seconds, so another process can serve stale
+// entities for that long once the cache is back. Writes fail as before if
+// the journal can't be written either.
+func WithDegradedWrites(journalKind string) ClientOption {
+	return func(cl *Client) {
+		cl.journal = &journal{kind: journalKind}
+	}
+}
+
+// journalEntry records a cache item to lock once the cache is reachable.
+type journalEntry struct {
+	Key   string    `datastore:",noindex"`
+	Flags uint32    `datastore:",noindex"`
+	Time  time.Time `datastore:",noindex"`
+}
+
+// journal tracks whether the journal needs replaying.
+type journal struct {
+	kind string
+
+	mu sync.Mutex
+	// dirty is set while journaled writes may not have been replayed. The
+	// cache is not read then.
+	dirty bool
+	// version counts the writes journaled by this Client.
+	version  int
+	replayed time.Time
+}
+
+// due reports whether the journal should be replayed before the cache is
+// read, and if not whether the cache can be read.
+func (j *journal) due() (replay, readable bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.dirty {
+		return time.Since(j.replayed) >= journalRetryInterval, false
+	}
+	return time.Since(j.replayed) >= journalPollInterval, true
+}
+
+// lockCache sets the lock items of a write, along with new query generations
+// for the kinds of keys so that cached queries can't outlive the write. If
+// that fails and degraded writes are enabled the items are journaled instead
+// and the write can go ahead. Items are journaled whole, as it is not known
+// which of them reached the cache.
+//
+// A failure to set any item fails the whole write, so the error is never a
+// datastore.MultiError: the cache reports errors per item, not per key.
+func (cl *Client) lockCache(c context.Context, lockItems []*Item,
+	keys []*datastore.Key) error {
+
+	items := append(lockItems[:len(lockItems):len(lockItems)],
+		cl.generationItems(keys)...)
+	err := cl.memcacheSetMulti(c, items)
+	if me, ok := err.(datastore.MultiError); ok {
+		err = firstError(me)
+	}
+	if err == nil || cl.journal == nil {
+		return err
+	}
+
+	now := time.Now()
+	entries := make([]journalEntry, 0, len(items))
+	for _, item := range items {
+		entries = append(entries, journalEntry{item.Key, item.Flags, now})
+	}
+	if jerr := cl.recordJournal(c, entries); jerr != nil {
+		cl.warn(c, "lockCache", "journal write failed", jerr,
+			"keys", len(items))
+		return err
+	}
+	cl.warn(c, "lockCache", "cache lock failed, write journaled", err,
+		"keys", len(items))
+	return nil
+}
+
+// recordJournal writes entries to the journal, in batches the datastore
+// accepts. Batches written before one fails are still replayed, which only
+// locks their keys for a while.
+func (cl *Client) recordJournal(c context.Context,
+	entries []journalEntry) error {
+
+	var err error
+	written := 0
+	for written < len(entries) {
+		batch := entries[written:]
+		if len(batch) > putMultiLimit {
+			batch = batch[:putMultiLimit]
+		}
+		keys := make([]*datastore.Key, len(batch))
+		for i := range keys {
+			keys[i] = datastore.IncompleteKey(cl.journal.kind, nil)
+		}
+		if _, err = cl.ds.PutMulti(c, keys, batch); err != nil {
+			break
+		}
+		written += len(batch)
+	}
+	if written == 0 {
+		return err
+	}
+
+	// Reads must wait for the replay.
+	cl.journal.mu.Lock()
+	defer cl.journal.mu.Unlock()
+	cl.journal.dirty = true
+	cl.journal.version++
+	cl.journal.replayed = time.Time{}
+	return err
+}
+
+// cacheReadable reports whether the cache can be read: the circuit breaker
+// is closed and no journaled write is waiting to be replayed.
+func (cl *Client) cacheReadable(c context.Context) bool {
+	if cl.breaker.isOpen() {
+		return false
+	}
+	if cl.journal == nil {
+		return true
+	}
+	replay, readable := cl.journal.due()
+	if !replay {
+		return readable
+	}
+
+	err := cl.replayJournal(c)
+	if err != nil {
+		cl.debug(c, "replayJournal", "journal replay failed", err)
+	}
+	return err == nil
+}
+
+// replayJournal locks the cache items of journaled writes and removes their
+// entries. The locks keep the entities from being cached until the writes
+// are done, as they would have been if the cache had been reachable.
+func (cl *Client) replayJournal(c context.Context) error {
+	j := cl.journal
+	j.mu.Lock()
+	version := j.version
+	j.mu.Unlock()
+
+	err := cl.replayJournalEntries(c)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.replayed = time.Now()
+	if err != nil {
+		j.dirty = true
+	} else if j.version == version {
+		j.dirty = false
+	}
+	return err
+}
+
+func (cl *Client) replayJournalEntries(c context.Context) error {
+	q := datastore.NewQuery(cl.journal.kind).Limit(journalReplayBatch)
+	for {
+		entries := []journalEntry{}
+		keys, err := cl.ds.GetAll(c, q, &entries)
+		if err != nil || len(keys) == 0 {
+			return err
+		}
+
+		items := make([]*Item, len(entries))
+		for i, entry := range entries {
+			items[i] = &Item{Key: entry.Key, Flags: entry.Flags}
+			if entry.Flags == generationItem {
+				items[i].Value = newGeneration()
+			} else {
+				items[i].Value = itemLock()
+				items[i].Expiration = memcacheLockTime
+			}
+		}
+		if err := cl.memcacheSetMulti(c, items); err != nil {
+			return err
+		}
+		cl.localCache.delete(journalMemcacheKeys(entries))
+		if err := cl.ds.DeleteMulti(c, keys); err != nil {
+			return err
+		}
+		if len(keys) < journalReplayBatch {
+			return nil
+		}
+	}
+}
+
+func journalMemcacheKeys(entries []journalEntry) []string {
+	keys := make([]string, len(entries))
+	for i, entry := range entries {
+		keys[i] = entry.Key
+	}
+	return keys
+}
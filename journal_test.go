@@ -0,0 +1,125 @@
+package nds_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/yoavfeld/nds"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestClientWithDegradedWrites(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	if _, err := nds.NewClient(nds.DsClient(), nds.WithCache(newMemoryCache()),
+		nds.WithDegradedWrites("")); err == nil {
+		t.Fatal("expected no journal kind error")
+	}
+
+	const journalKind = "NDSJournal"
+	cache := &failingCache{memoryCache: newMemoryCache()}
+	cl, err := nds.NewClient(nds.DsClient(), nds.WithCache(cache),
+		nds.WithDegradedWrites(journalKind))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := datastore.IDKey("JournalEntity", 1, nil)
+	if _, err := cl.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	// Cache the entity.
+	if err := cl.Get(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The put goes ahead while the cache is down.
+	cache.setDown(true)
+	if _, err := cl.Put(c, key, &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+	entity := &testEntity{}
+	if err := cl.Get(c, key, entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.Val != 2 {
+		t.Fatal("incorrect val while the cache is down", entity.Val)
+	}
+
+	// Once the cache is back the journal is replayed before it is read, so
+	// the entity cached before the put is not served.
+	cache.setDown(false)
+	time.Sleep(nds.JournalRetryInterval)
+	for i := 0; i < 2; i++ {
+		entity := &testEntity{}
+		if err := cl.Get(c, key, entity); err != nil {
+			t.Fatal(err)
+		}
+		if entity.Val != 2 {
+			t.Fatal("incorrect val after the cache is back", entity.Val)
+		}
+	}
+
+	keys, err := nds.DsClient().GetAll(c,
+		datastore.NewQuery(journalKind).KeysOnly(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Fatal("expected the journal to be empty", len(keys))
+	}
+
+	// Writes still fail without a degraded write policy.
+	strict, err := nds.NewClient(nds.DsClient(), nds.WithCache(cache))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.setDown(true)
+	if _, err := strict.Put(c, key, &testEntity{3}); err == nil {
+		t.Fatal("expected put to fail while the cache is down")
+	}
+}
+
+func TestDegradedWritesFullBatch(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	const journalKind = "NDSJournalFullBatch"
+	cache := &failingCache{memoryCache: newMemoryCache()}
+	cl, err := nds.NewClient(nds.DsClient(), nds.WithCache(cache),
+		nds.WithDegradedWrites(journalKind), nds.WithQueryCache(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A full batch journals a lock per key plus a query generation, more
+	// than the datastore takes at once.
+	keys := make([]*datastore.Key, 500)
+	for i := range keys {
+		keys[i] = datastore.IDKey("JournalEntity", int64(i+1), nil)
+	}
+	cache.setDown(true)
+	if _, err := cl.PutMulti(c, keys,
+		make([]testEntity, len(keys))); err != nil {
+		t.Fatal(err)
+	}
+
+	journal, err := nds.DsClient().GetAll(c,
+		datastore.NewQuery(journalKind).KeysOnly(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(journal) != len(keys)+1 {
+		t.Fatal("incorrect journal entries", len(journal))
+	}
+}
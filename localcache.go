@@ -0,0 +1,150 @@
+package nds
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// localCache is a size bounded, in-process LRU cache of entity and none items
+// that sits in front of the Cache. Its entries are only ever populated from
+// items that are also in the Cache and are dropped by local puts and deletes.
+// Writes made by other processes are not seen until an entry's TTL expires.
+//
+// A get may read an item before a local write and store it after the write
+// dropped its key. To stop that, gets take a snapshot before reading and set
+// ignores items of keys deleted since their snapshot.
+//
+// All methods are safe to call on a nil *localCache, which caches nothing.
+type localCache struct {
+	sync.Mutex
+	size  int
+	ttl   time.Duration
+	ll    *list.List
+	items map[string]*list.Element
+
+	// gen counts deletes. deleted holds the gen of the last delete of each
+	// recently deleted key. Older deletes are forgotten, so snapshots taken
+	// before floor can't set anything.
+	gen     uint64
+	floor   uint64
+	deleted map[string]uint64
+}
+
+type localCacheEntry struct {
+	key     string
+	flags   uint32
+	value   []byte
+	expires time.Time
+}
+
+func newLocalCache(size int, ttl time.Duration) *localCache {
+	return &localCache{
+		size:    size,
+		ttl:     ttl,
+		ll:      list.New(),
+		items:   make(map[string]*list.Element, size),
+		deleted: map[string]uint64{},
+	}
+}
+
+// snapshot returns the version of the cache to pass to set for items read
+// from now on.
+func (lc *localCache) snapshot() uint64 {
+	if lc == nil {
+		return 0
+	}
+
+	lc.Lock()
+	defer lc.Unlock()
+	return lc.gen
+}
+
+// get returns a copy of the item stored for key if it has not expired.
+func (lc *localCache) get(key string) (*Item, bool) {
+	if lc == nil {
+		return nil, false
+	}
+
+	lc.Lock()
+	defer lc.Unlock()
+
+	elem, ok := lc.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*localCacheEntry)
+	if time.Now().After(entry.expires) {
+		lc.removeElement(elem)
+		return nil, false
+	}
+	lc.ll.MoveToFront(elem)
+	return &Item{
+		Key:   entry.key,
+		Value: entry.value,
+		Flags: entry.flags,
+	}, true
+}
+
+// set stores item, evicting the least recently used entry if the cache is
+// full. Only entity and none items are stored, and only if their key hasn't
+// been deleted since snapshot was taken. A nonzero ttl shorter than the
+// cache's own stops the entry outliving the item's CachePolicy.
+func (lc *localCache) set(item *Item, snapshot uint64, ttl time.Duration) {
+	if lc == nil || (item.Flags != entityItem && item.Flags != noneItem) {
+		return
+	}
+
+	lc.Lock()
+	defer lc.Unlock()
+
+	if snapshot < lc.floor || lc.deleted[item.Key] > snapshot {
+		return
+	}
+
+	if ttl <= 0 || ttl > lc.ttl {
+		ttl = lc.ttl
+	}
+	entry := &localCacheEntry{
+		key:     item.Key,
+		flags:   item.Flags,
+		value:   item.Value,
+		expires: time.Now().Add(ttl),
+	}
+	if elem, ok := lc.items[item.Key]; ok {
+		elem.Value = entry
+		lc.ll.MoveToFront(elem)
+		return
+	}
+	lc.items[item.Key] = lc.ll.PushFront(entry)
+	for lc.ll.Len() > lc.size {
+		lc.removeElement(lc.ll.Back())
+	}
+}
+
+// delete removes keys from the cache.
+func (lc *localCache) delete(keys []string) {
+	if lc == nil {
+		return
+	}
+
+	lc.Lock()
+	defer lc.Unlock()
+
+	lc.gen++
+	if len(lc.deleted)+len(keys) > lc.size {
+		lc.floor = lc.gen
+		lc.deleted = map[string]uint64{}
+	}
+	for _, key := range keys {
+		lc.deleted[key] = lc.gen
+		if elem, ok := lc.items[key]; ok {
+			lc.removeElement(elem)
+		}
+	}
+}
+
+func (lc *localCache) removeElement(elem *list.Element) {
+	lc.ll.Remove(elem)
+	delete(lc.items, elem.Value.(*localCacheEntry).key)
+}
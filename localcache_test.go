@@ -0,0 +1,282 @@
+package nds_test
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yoavfeld/nds"
+
+	"cloud.google.com/go/datastore"
+	"golang.org/x/net/context"
+)
+
+// countingCache counts the GetMulti calls that reach the wrapped cache.
+type countingCache struct {
+	*memoryCache
+	gets int32
+}
+
+func (cc *countingCache) GetMulti(c context.Context,
+	keys []string) (map[string]*nds.Item, error) {
+	atomic.AddInt32(&cc.gets, 1)
+	return cc.memoryCache.GetMulti(c, keys)
+}
+
+func (cc *countingCache) resetGets() int32 {
+	return atomic.SwapInt32(&cc.gets, 0)
+}
+
+func TestLocalCache(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	cache := &countingCache{memoryCache: newMemoryCache()}
+	cl, err := nds.NewClient(nds.DsClient(), nds.WithCache(cache),
+		nds.WithLocalCache(10, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := datastore.IDKey("Entity", 1, nil)
+	if _, err := cl.Put(c, key, &testEntity{42}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Get from datastore.
+	te := &testEntity{}
+	if err := cl.Get(c, key, te); err != nil {
+		t.Fatal(err)
+	}
+	cache.resetGets()
+
+	// Get from local cache.
+	te = &testEntity{}
+	if err := cl.Get(c, key, te); err != nil {
+		t.Fatal(err)
+	}
+	if te.IntVal != 42 {
+		t.Fatal("te.IntVal != 42", te.IntVal)
+	}
+	if gets := cache.resetGets(); gets != 0 {
+		t.Fatal("expected no cache calls", gets)
+	}
+
+	// Callers must not share the same struct.
+	te.IntVal = 7
+	te = &testEntity{}
+	if err := cl.Get(c, key, te); err != nil {
+		t.Fatal(err)
+	}
+	if te.IntVal != 42 {
+		t.Fatal("te.IntVal != 42", te.IntVal)
+	}
+
+	// A local put invalidates the local cache.
+	if _, err := cl.Put(c, key, &testEntity{64}); err != nil {
+		t.Fatal(err)
+	}
+	cache.resetGets()
+	te = &testEntity{}
+	if err := cl.Get(c, key, te); err != nil {
+		t.Fatal(err)
+	}
+	if te.IntVal != 64 {
+		t.Fatal("te.IntVal != 64", te.IntVal)
+	}
+	if gets := cache.resetGets(); gets == 0 {
+		t.Fatal("expected cache calls")
+	}
+
+	// A local delete invalidates the local cache.
+	if err := cl.Delete(c, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Get(c, key, &testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity", err)
+	}
+}
+
+func TestLocalCacheEviction(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	cache := &countingCache{memoryCache: newMemoryCache()}
+	cl, err := nds.NewClient(nds.DsClient(), nds.WithCache(cache),
+		nds.WithLocalCache(1, 50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []*datastore.Key{
+		datastore.IDKey("Entity", 1, nil),
+		datastore.IDKey("Entity", 2, nil),
+	}
+	if _, err := cl.PutMulti(c, keys,
+		[]testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Prime the local cache with both keys, which only has room for one.
+	for _, key := range keys {
+		if err := cl.Get(c, key, &testEntity{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cache.resetGets()
+
+	if err := cl.Get(c, keys[1], &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if gets := cache.resetGets(); gets != 0 {
+		t.Fatal("expected no cache calls", gets)
+	}
+
+	// The first key was evicted.
+	if err := cl.Get(c, keys[0], &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if gets := cache.resetGets(); gets == 0 {
+		t.Fatal("expected cache calls")
+	}
+
+	// Entries expire after the TTL.
+	time.Sleep(60 * time.Millisecond)
+	if err := cl.Get(c, keys[0], &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if gets := cache.resetGets(); gets == 0 {
+		t.Fatal("expected cache calls")
+	}
+}
+
+func TestLocalCachePolicyTTL(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	cache := &countingCache{memoryCache: newMemoryCache()}
+	cl, err := nds.NewClient(nds.DsClient(), nds.WithCache(cache),
+		nds.WithLocalCache(10, time.Minute),
+		nds.WithCachePolicy("TTLEntity", nds.CachePolicy{
+			TTL: 100 * time.Millisecond,
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := datastore.IDKey("TTLEntity", 1, nil)
+	if _, err := cl.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Get(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	cache.resetGets()
+
+	if err := cl.Get(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if gets := cache.resetGets(); gets != 0 {
+		t.Fatal("expected no cache calls", gets)
+	}
+
+	// Entries expire after the policy TTL when it is shorter than the local
+	// cache's.
+	time.Sleep(150 * time.Millisecond)
+	if err := cl.Get(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if gets := cache.resetGets(); gets == 0 {
+		t.Fatal("expected cache calls")
+	}
+}
+
+// pausingCache is a memoryCache whose next GetMulti, once armed, waits after
+// reading until it is released.
+type pausingCache struct {
+	*memoryCache
+	armed   int32
+	read    chan struct{}
+	release chan struct{}
+}
+
+func (pc *pausingCache) GetMulti(c context.Context,
+	keys []string) (map[string]*nds.Item, error) {
+	items, err := pc.memoryCache.GetMulti(c, keys)
+	if atomic.CompareAndSwapInt32(&pc.armed, 1, 0) {
+		pc.read <- struct{}{}
+		<-pc.release
+	}
+	return items, err
+}
+
+func TestLocalCacheStaleSet(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	cache := &pausingCache{
+		memoryCache: newMemoryCache(),
+		read:        make(chan struct{}),
+		release:     make(chan struct{}),
+	}
+	cl, err := nds.NewClient(nds.DsClient(), nds.WithCache(cache),
+		nds.WithLocalCache(10, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := datastore.IDKey("Entity", 1, nil)
+	if _, err := cl.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cache the entity through a client without a local cache.
+	other, err := nds.NewClient(nds.DsClient(),
+		nds.WithCache(cache.memoryCache))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Get(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A get reads the old entity from the cache and a put finishes before it
+	// can store it locally.
+	atomic.StoreInt32(&cache.armed, 1)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- cl.Get(c, key, &testEntity{})
+	}()
+	<-cache.read
+	if _, err := cl.Put(c, key, &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+	close(cache.release)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	te := &testEntity{}
+	if err := cl.Get(c, key, te); err != nil {
+		t.Fatal(err)
+	}
+	if te.IntVal != 2 {
+		t.Fatal("expected the put entity", te.IntVal)
+	}
+}
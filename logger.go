@@ -0,0 +1,79 @@
+package nds
+
+import (
+	"log/slog"
+
+	"golang.org/x/net/context"
+)
+
+// Logger receives the events nds logs. A *slog.Logger satisfies it.
+//
+// Events carry the fields "op", the nds operation that logged them, and "err"
+// where there is one. Events about a single entity also carry "key", the
+// datastore key, "memcache_key" and "state", its cache state at the time.
+// Warnings mean the cache is not working as it should. Debug events are
+// expected under contention, such as a lock or compare and swap lost to a
+// concurrent call.
+type Logger interface {
+	DebugContext(c context.Context, msg string, args ...interface{})
+	WarnContext(c context.Context, msg string, args ...interface{})
+}
+
+// WithLogger sends the events the Client logs to logger. The default is
+// slog.Default().
+func WithLogger(logger Logger) ClientOption {
+	return func(cl *Client) {
+		cl.logger = logger
+	}
+}
+
+func (cl *Client) getLogger() Logger {
+	if cl.logger == nil {
+		return slog.Default()
+	}
+	return cl.logger
+}
+
+func (cl *Client) warn(c context.Context, op, msg string, err error,
+	args ...interface{}) {
+	cl.getLogger().WarnContext(c, "nds: "+msg, logArgs(op, err, args)...)
+}
+
+func (cl *Client) debug(c context.Context, op, msg string, err error,
+	args ...interface{}) {
+	cl.getLogger().DebugContext(c, "nds: "+msg, logArgs(op, err, args)...)
+}
+
+func logArgs(op string, err error, args []interface{}) []interface{} {
+	all := make([]interface{}, 0, len(args)+4)
+	all = append(all, "op", op)
+	if err != nil {
+		all = append(all, "err", err)
+	}
+	return append(all, args...)
+}
+
+// logArgs returns the fields that identify cacheItem in log events.
+func (cacheItem cacheItem) logArgs() []interface{} {
+	return []interface{}{
+		"key", cacheItem.key,
+		"memcache_key", cacheItem.memcacheKey,
+		"state", cacheItem.state,
+	}
+}
+
+func (s cacheState) String() string {
+	switch s {
+	case miss:
+		return "miss"
+	case internalLock:
+		return "internalLock"
+	case externalLock:
+		return "externalLock"
+	case done:
+		return "done"
+	case bypass:
+		return "bypass"
+	}
+	return "unknown"
+}
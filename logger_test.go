@@ -0,0 +1,110 @@
+package nds_test
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"testing"
+
+	"github.com/yoavfeld/nds"
+
+	"cloud.google.com/go/datastore"
+	"golang.org/x/net/context"
+)
+
+var _ nds.Logger = slog.Default()
+
+type logEvent struct {
+	level  string
+	msg    string
+	fields map[string]interface{}
+}
+
+// recordingLogger is an nds.Logger that keeps every event it receives.
+type recordingLogger struct {
+	sync.Mutex
+	events []logEvent
+}
+
+func (l *recordingLogger) record(level, msg string, args []interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	fields := map[string]interface{}{}
+	for i := 0; i+1 < len(args); i += 2 {
+		fields[args[i].(string)] = args[i+1]
+	}
+	l.events = append(l.events, logEvent{level, msg, fields})
+}
+
+func (l *recordingLogger) DebugContext(c context.Context, msg string,
+	args ...interface{}) {
+	l.record("debug", msg, args)
+}
+
+func (l *recordingLogger) WarnContext(c context.Context, msg string,
+	args ...interface{}) {
+	l.record("warn", msg, args)
+}
+
+func TestClientWithLogger(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	cache := newMemoryCache()
+	logger := &recordingLogger{}
+	cl, err := nds.NewClient(nds.DsClient(), nds.WithCache(cache),
+		nds.WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := datastore.IDKey("LoggerEntity", 1, nil)
+	if _, err := cl.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Plant an entity that can't be unmarshalled.
+	memcacheKey := nds.CreateMemcacheKey(key)
+	if err := cache.SetMulti(c, []*nds.Item{{
+		Key:   memcacheKey,
+		Flags: nds.EntityItem,
+		Value: []byte("garbage"),
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	entity := &testEntity{}
+	if err := cl.Get(c, key, entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.Val != 1 {
+		t.Fatal("incorrect val", entity.Val)
+	}
+
+	logger.Lock()
+	defer logger.Unlock()
+	for _, event := range logger.events {
+		if event.level != "warn" || event.fields["op"] != "loadMemcache" {
+			continue
+		}
+		if event.fields["err"] == nil {
+			t.Fatal("expected err field")
+		}
+		if k, ok := event.fields["key"].(*datastore.Key); !ok || !k.Equal(key) {
+			t.Fatal("expected key field", event.fields["key"])
+		}
+		if event.fields["memcache_key"] != memcacheKey {
+			t.Fatal("expected memcache_key field")
+		}
+		if s, ok := event.fields["state"].(fmt.Stringer); !ok ||
+			s.String() != "externalLock" {
+			t.Fatal("expected state field", event.fields["state"])
+		}
+		return
+	}
+	t.Fatal("expected loadMemcache warning", logger.events)
+}
@@ -1,87 +1,154 @@
 package nds
 
 import (
-	"golang.org/x/net/context"
-	"github.com/bradfitz/gomemcache/memcache"
+	"sync"
+	"time"
+
 	"cloud.google.com/go/datastore"
+	"github.com/bradfitz/gomemcache/memcache"
+	"golang.org/x/net/context"
 )
 
+// memcacheConcurrency is the number of gomemcache calls a memcacheClient
+// multi operation makes at once.
+const memcacheConcurrency = 16
+
+// memcacheClient is a Cache that stores items in memcache through a
+// gomemcache client. gomemcache has no multi operations other than GetMulti,
+// so the others make one call per item, memcacheConcurrency at a time.
 type memcacheClient struct {
 	*memcache.Client
 }
 
-func NewMemcache(addr string) *memcacheClient{
-	return &memcacheClient{memcache.New(addr)}
+// toMemcacheItem converts item into a gomemcache item. If item was returned by
+// GetMulti its compare and swap ID is carried over.
+func toMemcacheItem(item *Item) *memcache.Item {
+	mi := &memcache.Item{}
+	if casItem, ok := item.casInfo.(*memcache.Item); ok {
+		*mi = *casItem
+	}
+	mi.Key = item.Key
+	mi.Value = item.Value
+	mi.Flags = item.Flags
+	mi.Expiration = int32(memcacheExpiration(item.Expiration))
+	return mi
 }
 
-func (mc *memcacheClient) AddMulti(c context.Context, items []*memcache.Item) error {
-	if McClient == nil {
-		panic("memcache was not initialized. did you call nds.Init ?")
-	}
-	multiErr, any := make(datastore.MultiError, len(items)), false
+func toMemcacheItems(items []*Item) []*memcache.Item {
+	memcacheItems := make([]*memcache.Item, len(items))
 	for i, item := range items {
-		if err := mc.Add(item); err != nil {
-			multiErr[i] = err
-			any = true
-		}
+		memcacheItems[i] = toMemcacheItem(item)
 	}
-	if any {
-		return multiErr
-	}
-	return nil
+	return memcacheItems
 }
-func (mc *memcacheClient) SetMulti(c context.Context, items []*memcache.Item) error {
-	if McClient == nil {
-		panic("memcache was not initialized. did you call nds.Init ?")
-	}
-	multiErr, any := make(datastore.MultiError, len(items)), false
-	for i, item := range items {
-		if err := mc.Set(item); err != nil {
-			multiErr[i] = err
-			any = true
-		}
+
+// withContext runs op and waits for it to return or for c to be done,
+// whichever comes first. gomemcache calls can't be cancelled so op carries on
+// in the background if c is done first. It must not use anything the caller
+// may still change and its result is then dropped. Callers treat the error
+// like any other cache failure, which the locking protocol already allows
+// for.
+func withContext(c context.Context, op func() error) error {
+	if err := c.Err(); err != nil {
+		return err
 	}
-	if any {
-		return multiErr
+	errc := make(chan error, 1)
+	go func() {
+		errc <- op()
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-c.Done():
+		return c.Err()
 	}
-	return nil
 }
 
-func (mc *memcacheClient) GetMulti(c context.Context, keys []string) (map[string]*memcache.Item, error) {
-	return McClient.Client.GetMulti(keys)
+func (mc *memcacheClient) AddMulti(c context.Context, items []*Item) error {
+	memcacheItems := toMemcacheItems(items)
+	return withContext(c, func() error {
+		return forEachConcurrently(len(memcacheItems), func(i int) error {
+			return mc.Add(memcacheItems[i])
+		})
+	})
 }
 
-func (mc *memcacheClient) DeleteMulti(c context.Context, keys []string) error {
-	if McClient == nil {
-		panic("memcache was not initialized. did you call nds.Init ?")
+func (mc *memcacheClient) SetMulti(c context.Context, items []*Item) error {
+	memcacheItems := toMemcacheItems(items)
+	return withContext(c, func() error {
+		return forEachConcurrently(len(memcacheItems), func(i int) error {
+			return mc.Set(memcacheItems[i])
+		})
+	})
+}
+
+func (mc *memcacheClient) GetMulti(c context.Context, keys []string) (map[string]*Item, error) {
+	keys = append([]string(nil), keys...)
+	var memcacheItems map[string]*memcache.Item
+	if err := withContext(c, func() error {
+		var err error
+		memcacheItems, err = mc.Client.GetMulti(keys)
+		return err
+	}); err != nil {
+		return nil, err
 	}
-	multiErr, any := make(datastore.MultiError, len(keys)), false
-	for i, key := range keys {
-		if err := mc.Delete(key); err != nil {
-			multiErr[i] = err
-			any = true
+
+	items := make(map[string]*Item, len(memcacheItems))
+	for key, mi := range memcacheItems {
+		items[key] = &Item{
+			Key:        mi.Key,
+			Value:      mi.Value,
+			Flags:      mi.Flags,
+			Expiration: time.Duration(mi.Expiration) * time.Second,
+			casInfo:    mi,
 		}
 	}
-	if any {
-		return multiErr
-	}
-	return nil
+	return items, nil
 }
 
-func (mc *memcacheClient) CompareAndSwapMulti(c context.Context, items []*memcache.Item) error {
-	if McClient == nil {
-		panic("memcache was not initialized. did you call nds.Init ?")
-	}
-	multiErr, any := make(datastore.MultiError, len(items)), false
+func (mc *memcacheClient) DeleteMulti(c context.Context, keys []string) error {
+	keys = append([]string(nil), keys...)
+	return withContext(c, func() error {
+		return forEachConcurrently(len(keys), func(i int) error {
+			return mc.Delete(keys[i])
+		})
+	})
+}
+
+func (mc *memcacheClient) CompareAndSwapMulti(c context.Context, items []*Item) error {
+	memcacheItems := toMemcacheItems(items)
+	hasCAS := make([]bool, len(items))
 	for i, item := range items {
-		if err := mc.CompareAndSwap(item); err != nil {
-			multiErr[i] = err
-			any = true
-		}
+		_, hasCAS[i] = item.casInfo.(*memcache.Item)
 	}
-	if any {
-		return multiErr
-	}
-	return nil
+	return withContext(c, func() error {
+		return forEachConcurrently(len(memcacheItems), func(i int) error {
+			if !hasCAS[i] {
+				return memcache.ErrCASConflict
+			}
+			return mc.CompareAndSwap(memcacheItems[i])
+		})
+	})
 }
 
+// forEachConcurrently calls op for each index below n, memcacheConcurrency
+// at a time, and returns a datastore.MultiError of their errors in index
+// order if any failed.
+func forEachConcurrently(n int, op func(i int) error) error {
+	multiErr := make(datastore.MultiError, n)
+	sem := make(chan struct{}, memcacheConcurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			multiErr[i] = op(i)
+		}(i)
+	}
+	wg.Wait()
+	return multiErrorOrNil(multiErr)
+}
@@ -0,0 +1,401 @@
+package nds_test
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/yoavfeld/nds"
+
+	"cloud.google.com/go/datastore"
+	"github.com/bradfitz/gomemcache/memcache"
+	"golang.org/x/net/context"
+)
+
+func TestMemcacheContext(t *testing.T) {
+	// A server that accepts connections but never replies.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conns := []net.Conn{}
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	mc := memcache.New(l.Addr().String())
+	mc.Timeout = time.Minute
+	testMemcacheContext(t, nds.NewMemcacheCache(mc), &memcache.Item{Key: "key"})
+	testMemcacheContext(t, nds.NewMemcache(l.Addr().String()),
+		nds.MemcacheCASInfo(1))
+}
+
+func testMemcacheContext(t *testing.T, cache nds.Cache, casInfo interface{}) {
+	item := &nds.Item{Key: "key", Value: []byte("value")}
+	casItem := &nds.Item{Key: "key", Value: []byte("value")}
+	casItem.SetCASInfo(casInfo)
+	calls := map[string]func(c context.Context) error{
+		"AddMulti": func(c context.Context) error {
+			return cache.AddMulti(c, []*nds.Item{item})
+		},
+		"CompareAndSwapMulti": func(c context.Context) error {
+			return cache.CompareAndSwapMulti(c, []*nds.Item{casItem})
+		},
+		"DeleteMulti": func(c context.Context) error {
+			return cache.DeleteMulti(c, []string{item.Key})
+		},
+		"GetMulti": func(c context.Context) error {
+			_, err := cache.GetMulti(c, []string{item.Key})
+			return err
+		},
+		"SetMulti": func(c context.Context) error {
+			return cache.SetMulti(c, []*nds.Item{item})
+		},
+	}
+
+	for name, call := range calls {
+		c, cancel := context.WithTimeout(context.Background(),
+			50*time.Millisecond)
+		start := time.Now()
+		err := call(c)
+		cancel()
+		if err != context.DeadlineExceeded {
+			t.Fatal("expected context.DeadlineExceeded", name, err)
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("call ignored the deadline", name)
+		}
+
+		c, cancel = context.WithCancel(context.Background())
+		cancel()
+		if err := call(c); err != context.Canceled {
+			t.Fatal("expected context.Canceled", name, err)
+		}
+	}
+}
+
+func TestMemcachePipeline(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	cache := nds.NewMemcache(memcacheAddr)
+	prefix := fmt.Sprintf("pipeline%d:", time.Now().UnixNano())
+
+	// Enough items to need several gets commands.
+	items := make([]*nds.Item, 250)
+	keys := make([]string, len(items))
+	for i := range items {
+		keys[i] = prefix + strconv.Itoa(i)
+		items[i] = &nds.Item{
+			Key:   keys[i],
+			Value: []byte(strconv.Itoa(i)),
+			Flags: uint32(i),
+		}
+	}
+	if err := cache.SetMulti(c, items[1:]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the first item is added, the key with a space is malformed.
+	err := cache.AddMulti(c, []*nds.Item{
+		items[0], items[1], {Key: "bad key", Value: []byte("value")},
+	})
+	me, ok := err.(datastore.MultiError)
+	if !ok || len(me) != 3 || me[0] != nil ||
+		me[1] != memcache.ErrNotStored || me[2] != memcache.ErrMalformedKey {
+		t.Fatal("expected per item errors", err)
+	}
+
+	got, err := cache.GetMulti(c, append(keys, prefix+"missing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(items) {
+		t.Fatal("incorrect item count", len(got))
+	}
+	for i, key := range keys {
+		item := got[key]
+		if item == nil || string(item.Value) != strconv.Itoa(i) ||
+			item.Flags != uint32(i) {
+			t.Fatal("incorrect item", key, item)
+		}
+	}
+
+	// Swapping items[1] with a stale cas value fails.
+	stale := &nds.Item{Key: keys[1], Value: []byte("stale")}
+	stale.SetCASInfo(got[keys[1]].CASInfo())
+	if err := cache.SetMulti(c, []*nds.Item{items[1]}); err != nil {
+		t.Fatal(err)
+	}
+	fresh := got[keys[2]]
+	fresh.Value = []byte("fresh")
+	err = cache.CompareAndSwapMulti(c, []*nds.Item{stale, fresh})
+	if me, ok := err.(datastore.MultiError); !ok ||
+		me[0] != memcache.ErrCASConflict || me[1] != nil {
+		t.Fatal("expected a CAS conflict for the stale item", err)
+	}
+
+	err = cache.DeleteMulti(c, []string{keys[2], prefix + "missing"})
+	if me, ok := err.(datastore.MultiError); !ok ||
+		me[0] != nil || me[1] != memcache.ErrCacheMiss {
+		t.Fatal("expected a cache miss for the missing key", err)
+	}
+	got, err = cache.GetMulti(c, keys[:3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := got[keys[2]]; ok || len(got) != 2 {
+		t.Fatal("expected deleted item to be gone", got)
+	}
+}
+
+func TestMemcacheRing(t *testing.T) {
+	addrs := []string{"10.0.0.1:11211", "10.0.0.2:11211", "10.0.0.3:11211"}
+	before := nds.MemcacheRing(addrs...)
+	after := nds.MemcacheRing(append(addrs, "10.0.0.4:11211")...)
+
+	const keys = 10000
+	counts := map[string]int{}
+	moved := 0
+	for i := 0; i < keys; i++ {
+		key := "key" + strconv.Itoa(i)
+		counts[before(key)]++
+		if b, a := before(key), after(key); b != a {
+			if a != "10.0.0.4:11211" {
+				t.Fatal("key moved between old servers", key, b, a)
+			}
+			moved++
+		}
+	}
+
+	for _, addr := range addrs {
+		if counts[addr] < keys/5 || counts[addr] > keys/2 {
+			t.Fatal("unbalanced ring", counts)
+		}
+	}
+	// About a quarter of the keys should move to the new server.
+	if moved < keys/6 || moved > keys/3 {
+		t.Fatal("incorrect number of moved keys", moved)
+	}
+}
+
+func TestMemcacheExpiration(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want int64
+	}{
+		{0, 0},
+		{500 * time.Millisecond, 1},
+		{time.Second, 1},
+		{1500 * time.Millisecond, 2},
+		{30 * 24 * time.Hour, 30 * 24 * 60 * 60},
+	}
+	for _, test := range tests {
+		if got := nds.MemcacheExpiration(test.d); got != test.want {
+			t.Fatal("incorrect expiration", test.d, got, test.want)
+		}
+	}
+
+	// Longer expirations are absolute unix times.
+	now := time.Now().Unix()
+	got := nds.MemcacheExpiration(31 * 24 * time.Hour)
+	if want := now + 31*24*60*60; got < want || got > want+2 {
+		t.Fatal("expected an absolute expiration", got, want)
+	}
+}
+
+func TestMemcachePoolServerDown(t *testing.T) {
+	// A server that refuses connections.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	downAddr := l.Addr().String()
+	l.Close()
+
+	c := context.Background()
+	cache := nds.NewMemcache(memcacheAddr, downAddr)
+	server := nds.MemcacheRing(memcacheAddr, downAddr)
+	prefix := fmt.Sprintf("pool%d:", time.Now().UnixNano())
+
+	items := make([]*nds.Item, 100)
+	keys := make([]string, len(items))
+	for i := range items {
+		keys[i] = prefix + strconv.Itoa(i)
+		items[i] = &nds.Item{Key: keys[i], Value: []byte("value")}
+	}
+
+	// Only the keys of the down server fail, also once it is marked down.
+	for i := 0; i < 5; i++ {
+		err := cache.SetMulti(c, items)
+		me, ok := err.(datastore.MultiError)
+		if !ok {
+			t.Fatal("expected a datastore.MultiError", err)
+		}
+		for j, key := range keys {
+			if (server(key) == downAddr) != (me[j] != nil) {
+				t.Fatal("incorrect error", key, me[j])
+			}
+		}
+	}
+
+	got, err := cache.GetMulti(c, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if _, ok := got[key]; ok != (server(key) == memcacheAddr) {
+			t.Fatal("incorrect item", key)
+		}
+	}
+}
+
+func TestMemcachePoolServerDownWrites(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	downAddr := l.Addr().String()
+	l.Close()
+
+	cl, err := nds.NewClient(nds.DsClient(),
+		nds.WithCache(nds.NewMemcache(memcacheAddr, downAddr)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := nds.MemcacheRing(memcacheAddr, downAddr)
+
+	keys := make([]*datastore.Key, 20)
+	down := 0
+	for i := range keys {
+		keys[i] = datastore.IDKey("PoolEntity", int64(i+1), nil)
+		if server(nds.CreateMemcacheKey(keys[i])) == downAddr {
+			down++
+		}
+	}
+	if down == 0 || down == len(keys) {
+		t.Fatal("expected the keys to span both servers", down)
+	}
+
+	// Writes that can't lock every key fail for every key, and aren't made.
+	expectFailed := func(err error) {
+		me, ok := err.(datastore.MultiError)
+		if !ok || len(me) != len(keys) {
+			t.Fatal("expected a datastore.MultiError", err)
+		}
+		for i, e := range me {
+			if e == nil {
+				t.Fatal("expected an error", keys[i])
+			}
+		}
+	}
+	_, err = cl.PutMulti(c, keys, make([]testEntity, len(keys)))
+	expectFailed(err)
+	err = nds.DsClient().GetMulti(c, keys, make([]testEntity, len(keys)))
+	if me, ok := err.(datastore.MultiError); !ok ||
+		me[0] != datastore.ErrNoSuchEntity {
+		t.Fatal("expected the put not to be made", err)
+	}
+
+	if _, err := nds.DsClient().PutMulti(c, keys,
+		make([]testEntity, len(keys))); err != nil {
+		t.Fatal(err)
+	}
+	expectFailed(cl.DeleteMulti(c, keys))
+	if err := nds.DsClient().GetMulti(c, keys,
+		make([]testEntity, len(keys))); err != nil {
+		t.Fatal("expected the delete not to be made", err)
+	}
+}
+
+func TestNewMemcacheDiscovery(t *testing.T) {
+	c := context.Background()
+
+	if _, err := nds.NewMemcacheDiscovery(c,
+		func(c context.Context) ([]string, error) {
+			return nil, nil
+		}, time.Minute); err == nil {
+		t.Fatal("expected no servers error")
+	}
+
+	cache, err := nds.NewMemcacheDiscovery(c,
+		func(c context.Context) ([]string, error) {
+			return []string{memcacheAddr}, nil
+		}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := fmt.Sprintf("discovery%d", time.Now().UnixNano())
+	if err := cache.SetMulti(c, []*nds.Item{
+		{Key: key, Value: []byte("value")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if items, err := cache.GetMulti(c, []string{key}); err != nil ||
+		string(items[key].Value) != "value" {
+		t.Fatal("expected cached item", err)
+	}
+}
+
+// blockingCache is a memoryCache whose GetMulti blocks until its context is
+// done.
+type blockingCache struct {
+	*memoryCache
+}
+
+func (bc blockingCache) GetMulti(c context.Context,
+	keys []string) (map[string]*nds.Item, error) {
+	<-c.Done()
+	return nil, c.Err()
+}
+
+func TestClientWithCacheTimeout(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	cl, err := nds.NewClient(nds.DsClient(),
+		nds.WithCache(blockingCache{newMemoryCache()}),
+		nds.WithCacheTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := datastore.IDKey("TimeoutEntity", 1, nil)
+	if _, err := cl.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cache times out so the entity comes from the datastore.
+	entity := &testEntity{}
+	if err := cl.Get(c, key, entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.Val != 1 {
+		t.Fatal("incorrect val", entity.Val)
+	}
+}
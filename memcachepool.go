@@ -0,0 +1,324 @@
+package nds
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"golang.org/x/net/context"
+)
+
+const (
+	// memcacheRingReplicas is the number of points each server has on the
+	// consistent hash ring.
+	memcacheRingReplicas = 160
+
+	// memcacheDiscoveryTimeout bounds each call of a MemcacheDiscovery made
+	// to refresh the server list.
+	memcacheDiscoveryTimeout = 10 * time.Second
+)
+
+var (
+	errNoMemcacheServers  = errors.New("nds: no memcache servers")
+	errMemcacheServerDown = errors.New("nds: memcache server is down")
+)
+
+// MemcacheDiscovery returns the addresses of the memcache servers to use.
+type MemcacheDiscovery func(c context.Context) ([]string, error)
+
+// memcachePool is a Cache that spreads items over several memcache servers.
+// Keys are placed on a consistent hash ring so that adding or removing a
+// server only moves the keys next to its points.
+//
+// Keys of a server that is down fail without a network call, which sends
+// their entities down the datastore path while keys of other servers are
+// still cached. They are not moved to other servers as those could then hold
+// stale items for the keys once the server is back.
+type memcachePool struct {
+	discover MemcacheDiscovery
+	interval time.Duration
+
+	mu         sync.Mutex
+	ring       *memcacheRing
+	refreshed  time.Time
+	refreshing bool
+}
+
+// NewMemcache creates a Cache that stores items in the memcache servers at
+// addrs.
+func NewMemcache(addrs ...string) Cache {
+	return &memcachePool{ring: newMemcacheRing(addrs, nil)}
+}
+
+// NewMemcacheDiscovery creates a Cache that stores items in the memcache
+// servers returned by discover. discover is called with c before returning
+// and again every interval while the Cache is in use. If a later call fails
+// or returns no servers the previous list is kept.
+//
+// A server that leaves the list and rejoins it may hold stale items for keys
+// written while it was away, so flush it before adding it back.
+func NewMemcacheDiscovery(c context.Context, discover MemcacheDiscovery,
+	interval time.Duration) (Cache, error) {
+
+	addrs, err := discover(c)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, errNoMemcacheServers
+	}
+	return &memcachePool{
+		discover:  discover,
+		interval:  interval,
+		ring:      newMemcacheRing(addrs, nil),
+		refreshed: time.Now(),
+	}, nil
+}
+
+// currentRing returns the ring to place keys on, refreshing the server list
+// in the background if it is due.
+func (p *memcachePool) currentRing() *memcacheRing {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discover != nil && !p.refreshing &&
+		time.Since(p.refreshed) >= p.interval {
+		p.refreshing = true
+		go p.refresh()
+	}
+	return p.ring
+}
+
+func (p *memcachePool) refresh() {
+	c, cancel := context.WithTimeout(context.Background(),
+		memcacheDiscoveryTimeout)
+	defer cancel()
+	addrs, err := p.discover(c)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.refreshing = false
+	p.refreshed = time.Now()
+	if err == nil && len(addrs) > 0 {
+		p.ring = newMemcacheRing(addrs, p.ring)
+	}
+}
+
+func (p *memcachePool) AddMulti(c context.Context, items []*Item) error {
+	return p.storeMulti(c, items, (*memcacheServer).AddMulti)
+}
+
+func (p *memcachePool) SetMulti(c context.Context, items []*Item) error {
+	return p.storeMulti(c, items, (*memcacheServer).SetMulti)
+}
+
+func (p *memcachePool) CompareAndSwapMulti(c context.Context,
+	items []*Item) error {
+	return p.storeMulti(c, items, (*memcacheServer).CompareAndSwapMulti)
+}
+
+func (p *memcachePool) storeMulti(c context.Context, items []*Item,
+	op func(s *memcacheServer, c context.Context, items []*Item) error) error {
+
+	keys := make([]string, len(items))
+	for i, item := range items {
+		keys[i] = item.Key
+	}
+	return p.each(c, keys, func(s *memcacheServer, indexes []int) error {
+		serverItems := make([]*Item, len(indexes))
+		for i, index := range indexes {
+			serverItems[i] = items[index]
+		}
+		return op(s, c, serverItems)
+	})
+}
+
+func (p *memcachePool) DeleteMulti(c context.Context, keys []string) error {
+	return p.each(c, keys, func(s *memcacheServer, indexes []int) error {
+		serverKeys := make([]string, len(indexes))
+		for i, index := range indexes {
+			serverKeys[i] = keys[index]
+		}
+		return s.DeleteMulti(c, serverKeys)
+	})
+}
+
+// GetMulti returns the items found on the servers that answered. Keys of
+// servers that failed are missing from the result as if they were not
+// cached. An error is only returned if every server failed.
+func (p *memcachePool) GetMulti(c context.Context,
+	keys []string) (map[string]*Item, error) {
+
+	var mu sync.Mutex
+	items := make(map[string]*Item, len(keys))
+	err := p.each(c, keys, func(s *memcacheServer, indexes []int) error {
+		serverKeys := make([]string, len(indexes))
+		for i, index := range indexes {
+			serverKeys[i] = keys[index]
+		}
+		serverItems, err := s.GetMulti(c, serverKeys)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for key, item := range serverItems {
+			items[key] = item
+		}
+		return nil
+	})
+	if _, ok := err.(datastore.MultiError); ok {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// each groups keys by server and calls op concurrently with the indexes of
+// each server's keys. The errors of all servers are merged into a
+// datastore.MultiError in key order. If every server failed as a whole, or c
+// is done, a single error is returned instead.
+func (p *memcachePool) each(c context.Context, keys []string,
+	op func(s *memcacheServer, indexes []int) error) error {
+
+	if len(keys) == 0 {
+		return nil
+	}
+	ring := p.currentRing()
+	if len(ring.points) == 0 {
+		return errNoMemcacheServers
+	}
+
+	servers := map[*memcacheServer][]int{}
+	for i, key := range keys {
+		s := ring.server(key)
+		servers[s] = append(servers[s], i)
+	}
+
+	multiErr := make(datastore.MultiError, len(keys))
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		failed   int
+		firstErr error
+	)
+	for s, indexes := range servers {
+		wg.Add(1)
+		go func(s *memcacheServer, indexes []int) {
+			defer wg.Done()
+
+			var err error
+			if s.available() {
+				err = op(s, indexes)
+			} else {
+				err = errMemcacheServerDown
+			}
+			if err == nil {
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if me, ok := err.(datastore.MultiError); ok {
+				for i, index := range indexes {
+					multiErr[index] = me[i]
+				}
+				return
+			}
+			failed++
+			if firstErr == nil {
+				firstErr = err
+			}
+			for _, index := range indexes {
+				multiErr[index] = err
+			}
+		}(s, indexes)
+	}
+	wg.Wait()
+
+	err := multiErrorOrNil(multiErr)
+	if err == nil {
+		return nil
+	}
+	if cerr := c.Err(); cerr != nil {
+		return cerr
+	}
+	if failed == len(servers) {
+		return firstErr
+	}
+	return err
+}
+
+// memcacheRingPoint is a point of a server on the ring.
+type memcacheRingPoint struct {
+	hash   uint64
+	server *memcacheServer
+}
+
+// memcacheRing is an immutable consistent hash ring of memcache servers.
+type memcacheRing struct {
+	points  []memcacheRingPoint
+	servers map[string]*memcacheServer
+}
+
+// newMemcacheRing creates a ring of the servers at addrs. Servers that are
+// also in prev are carried over with their connections and health.
+func newMemcacheRing(addrs []string, prev *memcacheRing) *memcacheRing {
+	r := &memcacheRing{servers: make(map[string]*memcacheServer, len(addrs))}
+	for _, addr := range addrs {
+		if _, ok := r.servers[addr]; ok {
+			continue
+		}
+		s := (*memcacheServer)(nil)
+		if prev != nil {
+			s = prev.servers[addr]
+		}
+		if s == nil {
+			s = newMemcacheServer(addr)
+		}
+		r.servers[addr] = s
+
+		for i := 0; i < memcacheRingReplicas; i++ {
+			r.points = append(r.points, memcacheRingPoint{
+				hash:   memcacheRingHash(addr + "-" + strconv.Itoa(i)),
+				server: s,
+			})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		return r.points[i].hash < r.points[j].hash
+	})
+
+	if prev != nil {
+		for addr, s := range prev.servers {
+			if _, ok := r.servers[addr]; !ok {
+				s.close()
+			}
+		}
+	}
+	return r
+}
+
+// server returns the server key belongs to: the one with the first point at
+// or after the key's hash.
+func (r *memcacheRing) server(key string) *memcacheServer {
+	hash := memcacheRingHash(key)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= hash
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].server
+}
+
+func memcacheRingHash(s string) uint64 {
+	sum := md5.Sum([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
@@ -0,0 +1,524 @@
+package nds
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/bradfitz/gomemcache/memcache"
+	"golang.org/x/net/context"
+)
+
+const (
+	// memcacheServerTimeout bounds each pipeline sent to a memcache server
+	// and each dial.
+	memcacheServerTimeout = time.Second
+
+	// memcacheServerMaxIdleConns is the number of idle connections kept
+	// open to each memcache server.
+	memcacheServerMaxIdleConns = 4
+
+	// memcacheGetBatchSize is the number of keys requested by each gets
+	// command in a pipeline.
+	memcacheGetBatchSize = 100
+
+	// memcacheServerMaxFailures is the number of consecutive failed
+	// pipelines after which a server is marked down.
+	memcacheServerMaxFailures = 3
+
+	// memcacheServerRetryInterval is how long a server stays down before it
+	// is probed again.
+	memcacheServerRetryInterval = time.Second
+
+	// memcacheMaxRelativeExpiration is the largest expiration, in seconds,
+	// that memcache treats as relative to now. Larger ones are unix times.
+	memcacheMaxRelativeExpiration = 30 * 24 * 60 * 60
+)
+
+var (
+	errMemcacheProtocol = errors.New("nds: memcache protocol error")
+
+	// aLongTimeAgo is a deadline that unblocks pending network calls.
+	aLongTimeAgo = time.Unix(1, 0)
+)
+
+// memcacheServer talks the memcache text protocol to one server of a
+// memcachePool. It has the methods of a Cache for the keys placed on it and
+// tracks whether the server is up. The commands of each multi operation are
+// pipelined over one connection: they are all written before their replies,
+// which memcache sends in order, are read. A whole batch therefore costs
+// about one round trip however many items it holds.
+type memcacheServer struct {
+	addr string
+
+	mu   sync.Mutex
+	idle []net.Conn
+
+	// failures counts consecutive failed pipelines. Once it reaches
+	// memcacheServerMaxFailures the server is down until a probe made after
+	// retryAt succeeds.
+	failures int
+	retryAt  time.Time
+	probing  bool
+
+	closed bool
+}
+
+// memcacheCAS is the casInfo of items returned by memcacheServer.GetMulti.
+type memcacheCAS uint64
+
+func newMemcacheServer(addr string) *memcacheServer {
+	return &memcacheServer{addr: addr}
+}
+
+func (s *memcacheServer) AddMulti(c context.Context, items []*Item) error {
+	return s.store(c, "add", items)
+}
+
+func (s *memcacheServer) SetMulti(c context.Context, items []*Item) error {
+	return s.store(c, "set", items)
+}
+
+func (s *memcacheServer) CompareAndSwapMulti(c context.Context,
+	items []*Item) error {
+	return s.store(c, "cas", items)
+}
+
+func (s *memcacheServer) DeleteMulti(c context.Context, keys []string) error {
+	errs := make(datastore.MultiError, len(keys))
+	valid := make([]int, 0, len(keys))
+	for i, key := range keys {
+		if !legalMemcacheKey(key) {
+			errs[i] = memcache.ErrMalformedKey
+			continue
+		}
+		valid = append(valid, i)
+	}
+
+	if err := s.pipeline(c, func(w *bufio.Writer) error {
+		for _, i := range valid {
+			if _, err := fmt.Fprintf(w, "delete %s\r\n", keys[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, func(r *bufio.Reader) error {
+		for _, i := range valid {
+			line, err := readMemcacheLine(r)
+			if err != nil {
+				return err
+			}
+			switch {
+			case bytes.Equal(line, []byte("DELETED")):
+			case bytes.Equal(line, []byte("NOT_FOUND")):
+				errs[i] = memcache.ErrCacheMiss
+			default:
+				if errs[i] = memcacheReplyError(line); errs[i] == nil {
+					return errMemcacheProtocol
+				}
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	return multiErrorOrNil(errs)
+}
+
+func (s *memcacheServer) GetMulti(c context.Context,
+	keys []string) (map[string]*Item, error) {
+
+	valid := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if legalMemcacheKey(key) {
+			valid = append(valid, key)
+		}
+	}
+	batches := (len(valid) + memcacheGetBatchSize - 1) / memcacheGetBatchSize
+
+	items := make(map[string]*Item, len(valid))
+	if err := s.pipeline(c, func(w *bufio.Writer) error {
+		for i := 0; i < len(valid); i += memcacheGetBatchSize {
+			hi := i + memcacheGetBatchSize
+			if hi > len(valid) {
+				hi = len(valid)
+			}
+			if _, err := w.WriteString("gets"); err != nil {
+				return err
+			}
+			for _, key := range valid[i:hi] {
+				if _, err := w.WriteString(" " + key); err != nil {
+					return err
+				}
+			}
+			if _, err := w.WriteString("\r\n"); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, func(r *bufio.Reader) error {
+		for batch := 0; batch < batches; {
+			line, err := readMemcacheLine(r)
+			if err != nil {
+				return err
+			}
+			if bytes.Equal(line, []byte("END")) {
+				batch++
+				continue
+			}
+			item, err := readMemcacheValue(r, line)
+			if err != nil {
+				return err
+			}
+			items[item.Key] = item
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// store pipelines the storage command verb for each item.
+func (s *memcacheServer) store(c context.Context, verb string,
+	items []*Item) error {
+
+	errs := make(datastore.MultiError, len(items))
+	valid := make([]int, 0, len(items))
+	for i, item := range items {
+		if !legalMemcacheKey(item.Key) {
+			errs[i] = memcache.ErrMalformedKey
+			continue
+		}
+		if verb == "cas" {
+			if _, ok := item.casInfo.(memcacheCAS); !ok {
+				errs[i] = memcache.ErrCASConflict
+				continue
+			}
+		}
+		valid = append(valid, i)
+	}
+
+	if err := s.pipeline(c, func(w *bufio.Writer) error {
+		for _, i := range valid {
+			item := items[i]
+			if _, err := fmt.Fprintf(w, "%s %s %d %d %d", verb, item.Key,
+				item.Flags, memcacheExpiration(item.Expiration),
+				len(item.Value)); err != nil {
+				return err
+			}
+			if verb == "cas" {
+				if _, err := fmt.Fprintf(w, " %d",
+					item.casInfo.(memcacheCAS)); err != nil {
+					return err
+				}
+			}
+			if _, err := w.WriteString("\r\n"); err != nil {
+				return err
+			}
+			if _, err := w.Write(item.Value); err != nil {
+				return err
+			}
+			if _, err := w.WriteString("\r\n"); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, func(r *bufio.Reader) error {
+		for _, i := range valid {
+			line, err := readMemcacheLine(r)
+			if err != nil {
+				return err
+			}
+			switch {
+			case bytes.Equal(line, []byte("STORED")):
+			case bytes.Equal(line, []byte("NOT_STORED")):
+				errs[i] = memcache.ErrNotStored
+			case bytes.Equal(line, []byte("EXISTS")):
+				errs[i] = memcache.ErrCASConflict
+			case bytes.Equal(line, []byte("NOT_FOUND")):
+				errs[i] = memcache.ErrCacheMiss
+			default:
+				if errs[i] = memcacheReplyError(line); errs[i] == nil {
+					return errMemcacheProtocol
+				}
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	return multiErrorOrNil(errs)
+}
+
+// pipeline runs write and read concurrently on a connection to the server so
+// that neither side blocks on a full network buffer. If anything fails the
+// connection is closed rather than reused as its state is unknown.
+func (s *memcacheServer) pipeline(c context.Context,
+	write func(w *bufio.Writer) error, read func(r *bufio.Reader) error) error {
+
+	nc, err := s.conn(c)
+	if err != nil {
+		if cerr := c.Err(); cerr != nil {
+			return cerr
+		}
+		s.fail()
+		return err
+	}
+
+	// Deadlines in c are left to the goroutine below so that errors caused
+	// by them are always reported as c.Err().
+	nc.SetDeadline(time.Now().Add(memcacheServerTimeout))
+
+	// Unblock the connection if c is done first.
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-c.Done():
+			nc.SetDeadline(aLongTimeAgo)
+		case <-finished:
+		}
+	}()
+
+	writeErr := make(chan error, 1)
+	go func() {
+		w := bufio.NewWriter(nc)
+		err := write(w)
+		if err == nil {
+			err = w.Flush()
+		}
+		writeErr <- err
+	}()
+
+	err = read(bufio.NewReader(nc))
+	if err != nil {
+		// Unblock the writer.
+		nc.Close()
+	}
+	if werr := <-writeErr; err == nil {
+		err = werr
+	}
+	close(finished)
+
+	if err != nil {
+		nc.Close()
+		if cerr := c.Err(); cerr != nil {
+			return cerr
+		}
+		s.fail()
+		return err
+	}
+	s.succeed()
+	s.release(nc)
+	return nil
+}
+
+// available reports whether the server is up. Once a down server's retry
+// time has passed it starts a probe in the background, but stays down until
+// the probe succeeds.
+func (s *memcacheServer) available() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures < memcacheServerMaxFailures {
+		return true
+	}
+	if !s.probing && !time.Now().Before(s.retryAt) {
+		s.probing = true
+		go s.probe()
+	}
+	return false
+}
+
+// probe asks the server for its version, which marks it up if it answers.
+func (s *memcacheServer) probe() {
+	c, cancel := context.WithTimeout(context.Background(),
+		memcacheServerTimeout)
+	defer cancel()
+
+	s.pipeline(c, func(w *bufio.Writer) error {
+		_, err := w.WriteString("version\r\n")
+		return err
+	}, func(r *bufio.Reader) error {
+		line, err := readMemcacheLine(r)
+		if err != nil {
+			return err
+		}
+		if !bytes.HasPrefix(line, []byte("VERSION")) {
+			return errMemcacheProtocol
+		}
+		return nil
+	})
+
+	// pipeline has already recorded the outcome.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.probing = false
+}
+
+func (s *memcacheServer) fail() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures++
+	if s.failures >= memcacheServerMaxFailures {
+		s.retryAt = time.Now().Add(memcacheServerRetryInterval)
+		// Connections made before the failure are likely broken too.
+		s.closeIdle()
+	}
+}
+
+func (s *memcacheServer) succeed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = 0
+}
+
+// close closes the idle connections of a server that is no longer used.
+// Connections in use are closed when they are released.
+func (s *memcacheServer) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.closeIdle()
+}
+
+func (s *memcacheServer) closeIdle() {
+	for _, nc := range s.idle {
+		nc.Close()
+	}
+	s.idle = nil
+}
+
+// conn returns an idle connection to the server or dials a new one.
+func (s *memcacheServer) conn(c context.Context) (net.Conn, error) {
+	if err := c.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	if n := len(s.idle); n > 0 {
+		nc := s.idle[n-1]
+		s.idle = s.idle[:n-1]
+		s.mu.Unlock()
+		return nc, nil
+	}
+	s.mu.Unlock()
+
+	dialer := net.Dialer{Timeout: memcacheServerTimeout}
+	return dialer.DialContext(c, "tcp", s.addr)
+}
+
+// release returns a healthy connection to the idle pool.
+func (s *memcacheServer) release(nc net.Conn) {
+	nc.SetDeadline(time.Time{})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || len(s.idle) >= memcacheServerMaxIdleConns {
+		nc.Close()
+		return
+	}
+	s.idle = append(s.idle, nc)
+}
+
+// readMemcacheValue reads the data of the gets reply line and returns it as
+// an item.
+func readMemcacheValue(r *bufio.Reader, line []byte) (*Item, error) {
+	// VALUE <key> <flags> <bytes> <cas unique>
+	fields := bytes.Fields(line)
+	if len(fields) != 5 || !bytes.Equal(fields[0], []byte("VALUE")) {
+		if err := memcacheReplyError(line); err != nil {
+			return nil, err
+		}
+		return nil, errMemcacheProtocol
+	}
+	flags, err := strconv.ParseUint(string(fields[2]), 10, 32)
+	if err != nil {
+		return nil, errMemcacheProtocol
+	}
+	size, err := strconv.Atoi(string(fields[3]))
+	if err != nil || size < 0 {
+		return nil, errMemcacheProtocol
+	}
+	cas, err := strconv.ParseUint(string(fields[4]), 10, 64)
+	if err != nil {
+		return nil, errMemcacheProtocol
+	}
+	// Copy the key as reading the value reuses the buffer line is in.
+	key := string(fields[1])
+
+	value := make([]byte, size+2)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return nil, err
+	}
+	if !bytes.HasSuffix(value, []byte("\r\n")) {
+		return nil, errMemcacheProtocol
+	}
+	return &Item{
+		Key:     key,
+		Value:   value[:size],
+		Flags:   uint32(flags),
+		casInfo: memcacheCAS(cas),
+	}, nil
+}
+
+// readMemcacheLine reads a reply line without its terminator. The line is
+// only valid until the next read from r.
+func readMemcacheLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(line, []byte("\r\n")), nil
+}
+
+// memcacheReplyError returns memcache.ErrServerError for a SERVER_ERROR
+// reply, which only fails its own command, or nil for any other reply.
+func memcacheReplyError(line []byte) error {
+	if bytes.HasPrefix(line, []byte("SERVER_ERROR")) {
+		return memcache.ErrServerError
+	}
+	return nil
+}
+
+// memcacheExpiration converts d into a memcache expiration time. Memcache
+// counts in whole seconds and takes 0 to mean never, so d is rounded up.
+func memcacheExpiration(d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	seconds := int64((d + time.Second - 1) / time.Second)
+	if seconds > memcacheMaxRelativeExpiration {
+		return time.Now().Unix() + seconds
+	}
+	return seconds
+}
+
+// legalMemcacheKey reports whether key can be sent to memcache: at most 250
+// bytes with no spaces or control characters.
+func legalMemcacheKey(key string) bool {
+	if len(key) == 0 || len(key) > memcacheMaxKeySize {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+func multiErrorOrNil(me datastore.MultiError) error {
+	for _, err := range me {
+		if err != nil {
+			return me
+		}
+	}
+	return nil
+}
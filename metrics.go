@@ -0,0 +1,102 @@
+package nds
+
+import (
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"golang.org/x/net/context"
+)
+
+// Event is something the Client counts for each entity it happens to.
+type Event string
+
+// The events counted by the Client.
+const (
+	// EventLocalCacheHit is an entity or missing entity found in the local
+	// cache.
+	EventLocalCacheHit Event = "local_cache_hit"
+
+	// EventCacheHitEntity, EventCacheHitNone and EventCacheHitLock are items
+	// found by loadMemcache holding an entity, marking a missing entity, or
+	// locked by another call.
+	EventCacheHitEntity Event = "cache_hit_entity"
+	EventCacheHitNone   Event = "cache_hit_none"
+	EventCacheHitLock   Event = "cache_hit_lock"
+
+	// EventCacheMiss is an entity loadMemcache found no item for.
+	EventCacheMiss Event = "cache_miss"
+
+	// EventInternalLock and EventExternalLock are the locks lockMemcache
+	// took for a call and the items it found locked by another one.
+	EventInternalLock Event = "internal_lock"
+	EventExternalLock Event = "external_lock"
+
+	// EventCASFailure is an entity saveMemcache failed to swap into the
+	// cache.
+	EventCASFailure Event = "cas_failure"
+
+	// EventDatastoreFallback is an entity loaded from the datastore that
+	// could not be cached, because of a lock held by another call or a
+	// cache error.
+	EventDatastoreFallback Event = "datastore_fallback"
+
+	// EventCoalescedLoad is an entity a call got from the datastore read of
+	// another call, with WithCoalescedLoads.
+	EventCoalescedLoad Event = "coalesced_load"
+
+	// EventUnmarshalFailure and EventSetValueFailure are cached entities
+	// that could not be decoded or loaded into the destination value.
+	EventUnmarshalFailure Event = "unmarshal_failure"
+	EventSetValueFailure  Event = "set_value_failure"
+)
+
+// Metrics receives measurements of how the Client uses the cache. The
+// prommetrics and otelmetrics packages export them to Prometheus and
+// OpenTelemetry. Implementations must be safe for concurrent use.
+type Metrics interface {
+	// Count adds n to the number of times event happened to entities of
+	// kind.
+	Count(c context.Context, event Event, kind string, n int)
+
+	// ObserveLatency records how long a call of the Client method op took.
+	// kind is the kind of entity the call was for, or empty if it was for
+	// several kinds or the kind is not known.
+	ObserveLatency(c context.Context, op, kind string, d time.Duration)
+}
+
+// WithMetrics sends the Client's measurements to metrics.
+func WithMetrics(metrics Metrics) ClientOption {
+	return func(cl *Client) {
+		cl.metrics = metrics
+	}
+}
+
+func (cl *Client) count(c context.Context, event Event, key *datastore.Key) {
+	if cl.metrics != nil {
+		cl.metrics.Count(c, event, key.Kind, 1)
+	}
+}
+
+// observeLatency records the time since start. Call it with defer.
+func (cl *Client) observeLatency(c context.Context, op, kind string,
+	start time.Time) {
+	if cl.metrics != nil {
+		cl.metrics.ObserveLatency(c, op, kind, time.Since(start))
+	}
+}
+
+// keysKind returns the kind shared by all keys, or empty if there is none.
+func keysKind(keys []*datastore.Key) string {
+	kind := ""
+	for i, key := range keys {
+		if key == nil {
+			return ""
+		}
+		if i == 0 {
+			kind = key.Kind
+		} else if key.Kind != kind {
+			return ""
+		}
+	}
+	return kind
+}
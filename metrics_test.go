@@ -0,0 +1,137 @@
+package nds_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yoavfeld/nds"
+
+	"cloud.google.com/go/datastore"
+	"golang.org/x/net/context"
+)
+
+// recordingMetrics is an nds.Metrics that keeps counts and observed calls.
+type recordingMetrics struct {
+	sync.Mutex
+	counts map[nds.Event]map[string]int
+	ops    map[string]string
+}
+
+func newRecordingMetrics() *recordingMetrics {
+	return &recordingMetrics{
+		counts: map[nds.Event]map[string]int{},
+		ops:    map[string]string{},
+	}
+}
+
+func (m *recordingMetrics) Count(c context.Context, event nds.Event,
+	kind string, n int) {
+	m.Lock()
+	defer m.Unlock()
+	if m.counts[event] == nil {
+		m.counts[event] = map[string]int{}
+	}
+	m.counts[event][kind] += n
+}
+
+func (m *recordingMetrics) ObserveLatency(c context.Context, op, kind string,
+	d time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	m.ops[op] = kind
+}
+
+func (m *recordingMetrics) get(event nds.Event, kind string) int {
+	m.Lock()
+	defer m.Unlock()
+	return m.counts[event][kind]
+}
+
+func TestClientWithMetrics(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	cache := newMemoryCache()
+	metrics := newRecordingMetrics()
+	cl, err := nds.NewClient(nds.DsClient(), nds.WithCache(cache),
+		nds.WithMetrics(metrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []*datastore.Key{
+		datastore.IDKey("MetricsEntity", 1, nil),
+		datastore.IDKey("MetricsEntity", 2, nil),
+	}
+	if _, err := cl.Put(c, keys[0], &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Delete(c, keys[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first get misses and locks, the second hits.
+	for i := 0; i < 2; i++ {
+		err := cl.GetMulti(c, keys, make([]testEntity, 2))
+		if me, ok := err.(datastore.MultiError); !ok ||
+			me[0] != nil || me[1] != datastore.ErrNoSuchEntity {
+			t.Fatal("expected ErrNoSuchEntity for the second key", err)
+		}
+	}
+
+	expected := map[nds.Event]int{
+		nds.EventCacheMiss:      2,
+		nds.EventInternalLock:   2,
+		nds.EventCacheHitEntity: 1,
+		nds.EventCacheHitNone:   1,
+		nds.EventCASFailure:     0,
+	}
+	for event, count := range expected {
+		if got := metrics.get(event, "MetricsEntity"); got != count {
+			t.Fatal("incorrect count", event, got)
+		}
+	}
+
+	// A lock held by another call makes the entity come from the datastore.
+	if err := cache.SetMulti(c, []*nds.Item{{
+		Key:   nds.CreateMemcacheKey(keys[0]),
+		Flags: nds.LockItem,
+		Value: []byte{1},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Get(c, keys[0], &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := metrics.get(nds.EventCacheHitLock, "MetricsEntity"); got != 1 {
+		t.Fatal("incorrect lock hits", got)
+	}
+	if got := metrics.get(nds.EventDatastoreFallback,
+		"MetricsEntity"); got != 1 {
+		t.Fatal("incorrect datastore fallbacks", got)
+	}
+
+	if _, err := cl.RunInTransaction(c, func(tx *nds.Transaction) error {
+		_, err := tx.Put(keys[1], &testEntity{2})
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics.Lock()
+	defer metrics.Unlock()
+	for _, op := range []string{"GetMulti", "PutMulti", "DeleteMulti",
+		"Put", "Delete"} {
+		if kind, ok := metrics.ops[op]; !ok || kind != "MetricsEntity" {
+			t.Fatal("expected latency for", op, kind)
+		}
+	}
+	if _, ok := metrics.ops["RunInTransaction"]; !ok {
+		t.Fatal("expected latency for RunInTransaction")
+	}
+}
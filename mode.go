@@ -0,0 +1,66 @@
+package nds
+
+import (
+	"errors"
+
+	"golang.org/x/net/context"
+)
+
+// ErrCacheMiss is returned, in a datastore.MultiError for GetMulti, for each
+// entity that a get made with CacheOnly didn't find in the cache.
+var ErrCacheMiss = errors.New("nds: cache miss")
+
+var errInvalidCacheMode = errors.New("nds: invalid cache mode")
+
+// CacheMode changes how gets use the cache. Modes can be combined, such as
+// SkipCacheRead|SkipCacheWrite to go straight to the datastore.
+type CacheMode uint8
+
+const (
+	// SkipCacheRead ignores cached entities. Entities are loaded from the
+	// datastore and cached if the cache doesn't hold them already.
+	SkipCacheRead CacheMode = 1 << iota
+
+	// SkipCacheWrite stops entities loaded from the datastore from being
+	// cached.
+	SkipCacheWrite
+
+	// CacheOnly returns ErrCacheMiss for entities that are not cached instead
+	// of loading them from the datastore. It can't be combined with the other
+	// modes.
+	CacheOnly
+
+	// ForceRefresh loads entities from the datastore and replaces their
+	// cached copies, unless they are written meanwhile. It can't be combined
+	// with SkipCacheWrite or CacheOnly.
+	ForceRefresh
+)
+
+type cacheModeKey struct{}
+
+// WithCacheMode returns a copy of c in which gets use mode. Gets within
+// transactions don't use the cache whatever the mode.
+func WithCacheMode(c context.Context, mode CacheMode) context.Context {
+	return context.WithValue(c, cacheModeKey{}, mode)
+}
+
+// cacheModeFromContext returns the CacheMode set on c by WithCacheMode.
+func cacheModeFromContext(c context.Context) (CacheMode, error) {
+	mode, _ := c.Value(cacheModeKey{}).(CacheMode)
+	switch {
+	case mode&CacheOnly != 0 && mode != CacheOnly,
+		mode&ForceRefresh != 0 && mode&SkipCacheWrite != 0:
+		return 0, errInvalidCacheMode
+	}
+	return mode, nil
+}
+
+// readsCache reports whether cached entities can be returned.
+func (mode CacheMode) readsCache() bool {
+	return mode&(SkipCacheRead|ForceRefresh) == 0
+}
+
+// writesCache reports whether entities can be cached.
+func (mode CacheMode) writesCache() bool {
+	return mode&(SkipCacheWrite|CacheOnly) == 0
+}
@@ -0,0 +1,137 @@
+package nds_test
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/yoavfeld/nds"
+
+	"cloud.google.com/go/datastore"
+	"golang.org/x/net/context"
+)
+
+func TestClientWithCacheMode(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	cl, err := nds.NewClient(nds.DsClient(), nds.WithCache(newMemoryCache()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	getVal := func(mode nds.CacheMode, key *datastore.Key) (int, error) {
+		entity := &testEntity{}
+		err := cl.Get(nds.WithCacheMode(c, mode), key, entity)
+		return entity.Val, err
+	}
+	expectVal := func(mode nds.CacheMode, key *datastore.Key, val int) {
+		got, err := getVal(mode, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != val {
+			t.Fatal("incorrect val", mode, got, val)
+		}
+	}
+
+	if _, err := getVal(nds.CacheOnly|nds.SkipCacheRead,
+		datastore.IDKey("ModeEntity", 1, nil)); err == nil {
+		t.Fatal("expected invalid cache mode error")
+	}
+
+	// Cache the entity then change it behind nds' back.
+	key := datastore.IDKey("ModeEntity", 1, nil)
+	if _, err := cl.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	expectVal(0, key, 1)
+	if _, err := nds.DsClient().Put(c, key, &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+
+	expectVal(nds.CacheOnly, key, 1)
+	expectVal(nds.SkipCacheRead|nds.SkipCacheWrite, key, 2)
+	expectVal(nds.SkipCacheRead, key, 2)
+	expectVal(0, key, 1)
+
+	// ForceRefresh replaces the stale copy.
+	expectVal(nds.ForceRefresh, key, 2)
+	expectVal(nds.CacheOnly, key, 2)
+
+	// Uncached entities are only cached when the mode writes the cache.
+	otherKey := datastore.IDKey("ModeEntity", 2, nil)
+	if _, err := nds.DsClient().Put(c, otherKey, &testEntity{3}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getVal(nds.CacheOnly, otherKey); err != nds.ErrCacheMiss {
+		t.Fatal("expected ErrCacheMiss", err)
+	}
+	expectVal(nds.SkipCacheWrite, otherKey, 3)
+	if _, err := getVal(nds.CacheOnly, otherKey); err != nds.ErrCacheMiss {
+		t.Fatal("expected ErrCacheMiss", err)
+	}
+	expectVal(nds.SkipCacheRead, otherKey, 3)
+	expectVal(nds.CacheOnly, otherKey, 3)
+}
+
+func TestCacheModeBypassCoalescedLoads(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	cl, err := nds.NewClient(nds.DsClient(), nds.WithCache(newMemoryCache()),
+		nds.WithCoalescedLoads())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := datastore.IDKey("ModeEntity", 3, nil)
+	if _, err := cl.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hold the first read after it has read the entity.
+	var reads int32
+	read := make(chan struct{})
+	release := make(chan struct{})
+	nds.SetClientDatastoreGetMulti(cl, func(c context.Context,
+		keys []*datastore.Key, vals interface{}) error {
+		err := nds.DsClient().GetMulti(c, keys, vals)
+		if atomic.AddInt32(&reads, 1) == 1 {
+			close(read)
+			<-release
+		}
+		return err
+	})
+	errc := make(chan error, 1)
+	go func() {
+		errc <- cl.Get(c, key, &testEntity{})
+	}()
+	<-read
+
+	// Write behind nds' back. A get that bypasses the cache must read the
+	// new entity rather than share the read in flight.
+	if _, err := nds.DsClient().Put(c, key, &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+	entity := &testEntity{}
+	if err := cl.Get(nds.WithCacheMode(c,
+		nds.SkipCacheRead|nds.SkipCacheWrite), key, entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.Val != 2 {
+		t.Fatal("expected the written entity", entity.Val)
+	}
+
+	close(release)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -11,7 +11,6 @@ import (
 
 	"golang.org/x/net/context"
 	"cloud.google.com/go/datastore"
-	"fmt"
 )
 
 const (
@@ -22,7 +21,7 @@ const (
 	// held for. 32 seconds is chosen as 30 seconds is the maximum amount of
 	// time an underlying datastore call will retry even if the API reports a
 	// success to the user.
-	memcacheLockTime = 32
+	memcacheLockTime = 32 * time.Second
 
 	// memcacheMaxKeySize is the maximum size a memcache item key can be. Keys
 	// greater than this size are automatically hashed to a smaller size.
@@ -35,25 +34,7 @@ var (
 	typeOfPropertyList = reflect.TypeOf(datastore.PropertyList(nil))
 )
 
-// The variables in this block are here so that we can test all error code
-// paths by substituting them with error producing ones.
 var (
-	DsClient             *datastore.Client
-	datastoreDeleteMulti  = DsClient.DeleteMulti
-	datastoreGetMulti        = DsClient.GetMulti
-	datastorePutMulti        = DsClient.PutMulti
-
-	McClient *memcacheClient
-
-	memcacheAddMulti            = McClient.AddMulti
-	memcacheCompareAndSwapMulti = McClient.CompareAndSwapMulti
-	memcacheDeleteMulti         = McClient.DeleteMulti
-	memcacheGetMulti            = McClient.GetMulti
-	memcacheSetMulti            = McClient.SetMulti
-
-	marshal   = marshalPropertyList
-	unmarshal = unmarshalPropertyList
-
 	// memcacheNamespace is the namespace where all memcached entities are
 	// stored.
 	memcacheNamespace = ""
@@ -63,35 +44,21 @@ const (
 	noneItem uint32 = iota
 	entityItem
 	lockItem
+	queryItem
+	generationItem
+	chunkedItem
+	chunkItem
 )
 
-func InitNDS(c context.Context, memcacheAddr, datastoreProjectID string) error {
-	var err error
-	if DsClient, err = datastore.NewClient(c, datastoreProjectID); err != nil {
-		return fmt.Errorf("failed to create datastore client")
-	}
-	datastoreDeleteMulti  = DsClient.DeleteMulti
-	datastoreGetMulti        = DsClient.GetMulti
-	datastorePutMulti        = DsClient.PutMulti
-
-	McClient = NewMemcache(memcacheAddr)
-	memcacheAddMulti            = McClient.AddMulti
-	memcacheCompareAndSwapMulti = McClient.CompareAndSwapMulti
-	memcacheDeleteMulti         = McClient.DeleteMulti
-	memcacheGetMulti            = McClient.GetMulti
-	memcacheSetMulti            = McClient.SetMulti
-	return nil
-}
-
 func init() {
-	type GeoPoint struct {
-		Lat, Lng float64
-	}
+	// Register every type a datastore.Property value can hold so that gob
+	// can encode it through the interface{} field.
 	gob.Register(time.Time{})
-	//gob.Register(new([]byte))
 	gob.Register(&datastore.Key{})
 	gob.Register("")
-	gob.Register(GeoPoint{})
+	gob.Register(datastore.GeoPoint{})
+	gob.Register(&datastore.Entity{})
+	gob.Register([]interface{}{})
 }
 
 type valueType int
@@ -157,12 +124,18 @@ func checkKeysValues(keys []*datastore.Key, values reflect.Value) error {
 func createMemcacheKey(key *datastore.Key) string {
 	memcacheKey := memcachePrefix + key.Encode()
 	if len(memcacheKey) > memcacheMaxKeySize {
-		hash := sha1.Sum([]byte(memcacheKey))
-		memcacheKey = hex.EncodeToString(hash[:])
+		memcacheKey = hashMemcacheKey(memcacheKey)
 	}
 	return memcacheKey
 }
 
+// hashMemcacheKey turns memcacheKey into a fixed size key that is safe to use
+// whatever characters memcacheKey contains.
+func hashMemcacheKey(memcacheKey string) string {
+	hash := sha1.Sum([]byte(memcacheKey))
+	return hex.EncodeToString(hash[:])
+}
+
 func memcacheContext(c context.Context) (context.Context, error) {
 	return c, nil
 }
@@ -207,6 +180,16 @@ func isErrorsNil(errs []error) bool {
 	return true
 }
 
+// firstError returns the first error of errs, or nil if there is none.
+func firstError(errs []error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func groupErrors(errs []error, total, limit int) error {
 	groupedErrs := make(datastore.MultiError, total)
 	for i, err := range errs {
@@ -13,7 +13,6 @@ import (
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
 	"cloud.google.com/go/datastore"
-	"github.com/bradfitz/gomemcache/memcache"
 	"log"
 )
 
@@ -40,20 +39,20 @@ func TestPutGetDelete(t *testing.T) {
 	// Check we set memcahce, put datastore and delete memcache.
 	seq := make(chan string, 3)
 	nds.SetMemcacheSetMulti(func(c context.Context,
-		items []*memcache.Item) error {
+		items []*nds.Item) error {
 		seq <- "nds.McClient.SetMulti"
-		return nds.McClient.SetMulti(c, items)
+		return nds.McClient().SetMulti(c, items)
 	})
 	nds.SetDatastorePutMulti(func(c context.Context,
 		keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error) {
 		seq <- "nds.DsClient.PutMulti"
-		return nds.DsClient.PutMulti(c, keys, vals)
+		return nds.DsClient().PutMulti(c, keys, vals)
 	})
 	nds.SetMemcacheDeleteMulti(func(c context.Context,
 		keys []string) error {
 		seq <- "nds.McClient.DeleteMulti"
 		close(seq)
-		return nds.McClient.DeleteMulti(c, keys)
+		return nds.McClient().DeleteMulti(c, keys)
 	})
 
 	incompleteKey := datastore.IncompleteKey("Entity", nil)
@@ -62,18 +61,18 @@ func TestPutGetDelete(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	nds.SetMemcacheSetMulti(nds.McClient.SetMulti)
-	nds.SetDatastorePutMulti(nds.DsClient.PutMulti)
-	nds.SetMemcacheDeleteMulti(nds.McClient.DeleteMulti)
+	nds.SetMemcacheSetMulti(nds.McClient().SetMulti)
+	nds.SetDatastorePutMulti(nds.DsClient().PutMulti)
+	nds.SetMemcacheDeleteMulti(nds.McClient().DeleteMulti)
 
 	if s := <-seq; s != "nds.McClient.SetMulti" {
-		t.Fatal("nds.McClient.SetMulti not", s)
+		t.Fatal("nds.McClient().SetMulti not", s)
 	}
 	if s := <-seq; s != "nds.DsClient.PutMulti" {
-		t.Fatal("nds.DsClient.PutMulti not", s)
+		t.Fatal("nds.DsClient().PutMulti not", s)
 	}
 	if s := <-seq; s != "nds.McClient.DeleteMulti" {
-		t.Fatal("nds.McClient.DeleteMulti not", s)
+		t.Fatal("nds.McClient().DeleteMulti not", s)
 	}
 	// Check chan is closed.
 	<-seq
@@ -491,34 +490,30 @@ func TestRunInTransaction(t *testing.T) {
 	if _, err := nds.PutMulti(c, keys, entities); err != nil {
 		t.Fatal(err)
 	}
-	// TODO: enable
-	//err := nds.RunInTransaction(c, func(tc context.Context) error {
-	//	entities := make([]testEntity, 1, 1)
-	//	if err := nds.GetMulti(tc, keys, entities); err != nil {
-	//		t.Fatal(err)
-	//	}
-	//	entity := entities[0]
-	//
-	//	if entity.Val != 42 {
-	//		t.Fatalf("entity.Val != 42: %d", entity.Val)
-	//	}
-	//
-	//	entities[0].Val = 43
-	//
-	//	putKeys, err := nds.PutMulti(tc, keys, entities)
-	//	if err != nil {
-	//		t.Fatal(err)
-	//	} else if len(putKeys) != 1 {
-	//		t.Fatal("putKeys should be len 1")
-	//	} else if !putKeys[0].Equal(key) {
-	//		t.Fatal("keys not equal")
-	//	}
-	//	return nil
-	//
-	//}, nil)
-	//if err != nil {
-	//	t.Fatal(err)
-	//}
+	if _, err := nds.RunInTransaction(c, func(tx *nds.Transaction) error {
+		entities := make([]testEntity, 1, 1)
+		if err := tx.GetMulti(keys, entities); err != nil {
+			t.Fatal(err)
+		}
+		entity := entities[0]
+
+		if entity.Val != 42 {
+			t.Fatalf("entity.Val != 42: %d", entity.Val)
+		}
+
+		entities[0].Val = 43
+
+		putKeys, err := tx.PutMulti(keys, entities)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(putKeys) != 1 {
+			t.Fatal("putKeys should be len 1")
+		}
+		return nil
+
+	}); err != nil {
+		t.Fatal(err)
+	}
 
 	entities = make([]testEntity, 1, 1)
 	if err := nds.GetMulti(c, keys, entities); err != nil {
@@ -0,0 +1,52 @@
+// Package otelmetrics exports nds metrics through the OpenTelemetry metrics
+// API.
+package otelmetrics
+
+import (
+	"time"
+
+	"github.com/yoavfeld/nds"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"golang.org/x/net/context"
+)
+
+// Metrics is an nds.Metrics that records to OpenTelemetry instruments. It
+// records the counter nds.cache.events, with event and kind attributes, and
+// the histogram nds.call.duration, in seconds, with op and kind attributes.
+type Metrics struct {
+	events   metric.Int64Counter
+	duration metric.Float64Histogram
+}
+
+// New creates a Metrics whose instruments are created by meter.
+func New(meter metric.Meter) (*Metrics, error) {
+	events, err := meter.Int64Counter("nds.cache.events",
+		metric.WithDescription("Number of cache events by event and entity kind."))
+	if err != nil {
+		return nil, err
+	}
+	duration, err := meter.Float64Histogram("nds.call.duration",
+		metric.WithDescription("Duration of nds calls by operation and entity kind."),
+		metric.WithUnit("s"))
+	if err != nil {
+		return nil, err
+	}
+	return &Metrics{events: events, duration: duration}, nil
+}
+
+// Count implements nds.Metrics.
+func (m *Metrics) Count(c context.Context, event nds.Event, kind string,
+	n int) {
+	m.events.Add(c, int64(n), metric.WithAttributes(
+		attribute.String("event", string(event)),
+		attribute.String("kind", kind)))
+}
+
+// ObserveLatency implements nds.Metrics.
+func (m *Metrics) ObserveLatency(c context.Context, op, kind string,
+	d time.Duration) {
+	m.duration.Record(c, d.Seconds(), metric.WithAttributes(
+		attribute.String("op", op),
+		attribute.String("kind", kind)))
+}
@@ -0,0 +1,58 @@
+package otelmetrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/yoavfeld/nds"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"golang.org/x/net/context"
+)
+
+var _ nds.Metrics = &Metrics{}
+
+func TestMetrics(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	m, err := New(provider.Meter("nds"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := context.Background()
+	m.Count(c, nds.EventCacheHitEntity, "Entity", 2)
+	m.Count(c, nds.EventCacheHitEntity, "Entity", 1)
+	m.ObserveLatency(c, "GetMulti", "Entity", time.Millisecond)
+
+	rm := metricdata.ResourceMetrics{}
+	if err := reader.Collect(c, &rm); err != nil {
+		t.Fatal(err)
+	}
+	if len(rm.ScopeMetrics) != 1 {
+		t.Fatal("expected one scope", len(rm.ScopeMetrics))
+	}
+
+	found := 0
+	for _, metrics := range rm.ScopeMetrics[0].Metrics {
+		switch metrics.Name {
+		case "nds.cache.events":
+			sum, ok := metrics.Data.(metricdata.Sum[int64])
+			if !ok || len(sum.DataPoints) != 1 ||
+				sum.DataPoints[0].Value != 3 {
+				t.Fatal("incorrect events", metrics.Data)
+			}
+			found++
+		case "nds.call.duration":
+			hist, ok := metrics.Data.(metricdata.Histogram[float64])
+			if !ok || len(hist.DataPoints) != 1 ||
+				hist.DataPoints[0].Count != 1 {
+				t.Fatal("incorrect duration", metrics.Data)
+			}
+			found++
+		}
+	}
+	if found != 2 {
+		t.Fatal("expected both instruments", found)
+	}
+}
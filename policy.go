@@ -0,0 +1,72 @@
+package nds
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// CachePolicy controls how the entities of a kind are cached. The zero value
+// is the default policy: entities and missing entities are cached until they
+// are evicted.
+type CachePolicy struct {
+	// NoCache keeps the entities out of the cache. Reads always go to the
+	// datastore and writes don't lock the cache, so they keep working when
+	// it is down. Every Client sharing the cache must agree on NoCache for a
+	// kind, and the cache must be flushed before a kind starts to use it.
+	NoCache bool
+
+	// TTL is how long entities stay cached, in the local cache too. Zero
+	// means until they are evicted.
+	TTL time.Duration
+
+	// NoNegativeCache stops missing entities from being cached, so each read
+	// of a missing entity goes to the datastore.
+	NoNegativeCache bool
+
+	// MaxItemSize is the largest encoded entity, in bytes, that is cached.
+	// Larger entities are read from the datastore each time. Zero means no
+	// limit other than the chunking done for entities larger than the
+	// cache's item size limit.
+	MaxItemSize int
+}
+
+// WithCachePolicy sets the CachePolicy of entities of kind.
+func WithCachePolicy(kind string, policy CachePolicy) ClientOption {
+	return func(cl *Client) {
+		if cl.cachePolicies == nil {
+			cl.cachePolicies = map[string]CachePolicy{}
+		}
+		cl.cachePolicies[kind] = policy
+	}
+}
+
+// cachePolicyKey is the context key of a CachePolicy set for a kind by
+// WithCachePolicyContext.
+type cachePolicyKey struct {
+	kind string
+}
+
+// WithCachePolicyContext returns a copy of c in which reads of entities of
+// kind use policy instead of the one set on the Client. Writes always use the
+// Client's policy so that the locks the cache relies on are taken, and reads
+// of a kind the Client doesn't cache never use the cache.
+func WithCachePolicyContext(c context.Context, kind string,
+	policy CachePolicy) context.Context {
+	return context.WithValue(c, cachePolicyKey{kind}, policy)
+}
+
+// readPolicy returns the CachePolicy used to read entities of kind.
+func (cl *Client) readPolicy(c context.Context, kind string) CachePolicy {
+	policy := cl.cachePolicies[kind]
+	if override, ok := c.Value(cachePolicyKey{kind}).(CachePolicy); ok &&
+		!policy.NoCache {
+		return override
+	}
+	return policy
+}
+
+// writePolicy returns the CachePolicy used to write entities of kind.
+func (cl *Client) writePolicy(kind string) CachePolicy {
+	return cl.cachePolicies[kind]
+}
@@ -0,0 +1,132 @@
+package nds_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/yoavfeld/nds"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestClientWithCachePolicy(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	if _, err := nds.NewClient(nds.DsClient(), nds.WithCache(newMemoryCache()),
+		nds.WithCachePolicy("Entity", nds.CachePolicy{TTL: -1})); err == nil {
+		t.Fatal("expected invalid cache policy error")
+	}
+
+	const ttl = time.Hour
+	cache := &failingCache{memoryCache: newMemoryCache()}
+	cl, err := nds.NewClient(nds.DsClient(), nds.WithCache(cache),
+		nds.WithCachePolicy("NoCacheEntity", nds.CachePolicy{NoCache: true}),
+		nds.WithCachePolicy("TTLEntity", nds.CachePolicy{
+			TTL:             ttl,
+			NoNegativeCache: true,
+		}),
+		nds.WithCachePolicy("SmallEntity", nds.CachePolicy{MaxItemSize: 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cached := func(key *datastore.Key) (nds.Item, bool) {
+		cache.Lock()
+		defer cache.Unlock()
+		item, ok := cache.items[nds.CreateMemcacheKey(key)]
+		return item, ok
+	}
+
+	// Uncached kinds don't need the cache at all.
+	cache.setDown(true)
+	noCacheKey := datastore.IDKey("NoCacheEntity", 1, nil)
+	if _, err := cl.Put(c, noCacheKey, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	entity := &testEntity{}
+	if err := cl.Get(c, noCacheKey, entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.Val != 1 {
+		t.Fatal("incorrect val", entity.Val)
+	}
+	if err := cl.Delete(c, noCacheKey); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nor with cached queries, as their queries aren't cached.
+	qcl, err := nds.NewClient(nds.DsClient(), nds.WithCache(cache),
+		nds.WithCachePolicy("NoCacheEntity", nds.CachePolicy{NoCache: true}),
+		nds.WithQueryCache(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := qcl.Put(c, noCacheKey, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	var entities []testEntity
+	if _, err := qcl.RunQuery(c, "NoCacheEntity", "all",
+		datastore.NewQuery("NoCacheEntity"), &entities); err != nil {
+		t.Fatal(err)
+	}
+	if err := qcl.Delete(c, noCacheKey); err != nil {
+		t.Fatal(err)
+	}
+	if calls := cache.callCount(); calls != 0 {
+		t.Fatal("expected no cache calls", calls)
+	}
+	cache.setDown(false)
+
+	// Cached entities expire after the TTL, and missing ones aren't cached.
+	ttlKey := datastore.IDKey("TTLEntity", 1, nil)
+	if err := cl.Get(c, ttlKey, &testEntity{}); err !=
+		datastore.ErrNoSuchEntity {
+		t.Fatal("expected ErrNoSuchEntity", err)
+	}
+	if item, ok := cached(ttlKey); ok && item.Flags != nds.LockItem {
+		t.Fatal("expected the missing entity not to be cached", item.Flags)
+	}
+	if _, err := cl.Put(c, ttlKey, &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+	cache.DeleteMulti(c, []string{nds.CreateMemcacheKey(ttlKey)})
+	if err := cl.Get(c, ttlKey, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if item, ok := cached(ttlKey); !ok || item.Expiration != ttl {
+		t.Fatal("expected the entity to be cached with the TTL", item)
+	}
+
+	// Entities over the size limit aren't cached.
+	smallKey := datastore.IDKey("SmallEntity", 1, nil)
+	if _, err := cl.Put(c, smallKey, &testEntity{3}); err != nil {
+		t.Fatal(err)
+	}
+	cache.DeleteMulti(c, []string{nds.CreateMemcacheKey(smallKey)})
+	if err := cl.Get(c, smallKey, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if item, ok := cached(smallKey); !ok || item.Flags != nds.LockItem {
+		t.Fatal("expected the entity not to be cached", item.Flags)
+	}
+
+	// A context policy keeps gets away from the cache.
+	calls := cache.callCount()
+	pc := nds.WithCachePolicyContext(c, "TTLEntity",
+		nds.CachePolicy{NoCache: true})
+	entity = &testEntity{}
+	if err := cl.Get(pc, ttlKey, entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.Val != 2 {
+		t.Fatal("incorrect val", entity.Val)
+	}
+	if got := cache.callCount(); got != calls {
+		t.Fatal("expected no cache calls", got-calls)
+	}
+}
@@ -0,0 +1,55 @@
+// Package prommetrics exports nds metrics to Prometheus.
+package prommetrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yoavfeld/nds"
+	"golang.org/x/net/context"
+)
+
+// Metrics is an nds.Metrics that records to Prometheus collectors. It
+// exports the counter nds_cache_events_total, labelled by event and kind, and
+// the histogram nds_call_duration_seconds, labelled by op and kind.
+type Metrics struct {
+	events   *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+// New creates a Metrics and registers its collectors with reg.
+func New(reg prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{
+		events: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "nds",
+			Name:      "cache_events_total",
+			Help:      "Number of cache events by event and entity kind.",
+		}, []string{"event", "kind"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "nds",
+			Name:      "call_duration_seconds",
+			Help:      "Duration of nds calls by operation and entity kind.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"op", "kind"}),
+	}
+	if err := reg.Register(m.events); err != nil {
+		return nil, err
+	}
+	if err := reg.Register(m.duration); err != nil {
+		reg.Unregister(m.events)
+		return nil, err
+	}
+	return m, nil
+}
+
+// Count implements nds.Metrics.
+func (m *Metrics) Count(c context.Context, event nds.Event, kind string,
+	n int) {
+	m.events.WithLabelValues(string(event), kind).Add(float64(n))
+}
+
+// ObserveLatency implements nds.Metrics.
+func (m *Metrics) ObserveLatency(c context.Context, op, kind string,
+	d time.Duration) {
+	m.duration.WithLabelValues(op, kind).Observe(d.Seconds())
+}
@@ -0,0 +1,44 @@
+package prommetrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/yoavfeld/nds"
+	"golang.org/x/net/context"
+)
+
+var _ nds.Metrics = &Metrics{}
+
+func TestMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, err := New(reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := context.Background()
+	m.Count(c, nds.EventCacheHitEntity, "Entity", 2)
+	m.Count(c, nds.EventCacheHitEntity, "Entity", 1)
+	m.Count(c, nds.EventCacheMiss, "Entity", 1)
+	m.ObserveLatency(c, "GetMulti", "Entity", time.Millisecond)
+
+	if v := testutil.ToFloat64(m.events.WithLabelValues(
+		string(nds.EventCacheHitEntity), "Entity")); v != 3 {
+		t.Fatal("incorrect hit count", v)
+	}
+	if v := testutil.ToFloat64(m.events.WithLabelValues(
+		string(nds.EventCacheMiss), "Entity")); v != 1 {
+		t.Fatal("incorrect miss count", v)
+	}
+	if n := testutil.CollectAndCount(m.duration); n != 1 {
+		t.Fatal("expected one histogram", n)
+	}
+
+	// The collectors can only be registered once.
+	if _, err := New(reg); err == nil {
+		t.Fatal("expected register error")
+	}
+}
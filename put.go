@@ -3,24 +3,40 @@ package nds
 import (
 	"reflect"
 	"sync"
+	"time"
 
 	"golang.org/x/net/context"
 	"cloud.google.com/go/datastore"
-	"github.com/bradfitz/gomemcache/memcache"
-	"log"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // putMultiLimit is the App Engine datastore limit for the maximum number
 // of entities that can be put by datastore.PutMulti at once.
 const putMultiLimit = 500
 
+// PutMulti calls Client.PutMulti on the default client.
+func PutMulti(c context.Context,
+	keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error) {
+	return getDefaultClient().PutMulti(c, keys, vals)
+}
+
+// Put calls Client.Put on the default client.
+func Put(c context.Context,
+	key *datastore.Key, val interface{}) (*datastore.Key, error) {
+	return getDefaultClient().Put(c, key, val)
+}
+
 // PutMulti is a batch version of Put. It works just like datastore.PutMulti
 // except it interacts appropriately with NDS's caching strategy. It also
 // removes the API limit of 500 entities per request by calling the datastore as
 // many times as required to put all the keys. It does this efficiently and
 // concurrently.
-func PutMulti(c context.Context,
-	keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error) {
+func (cl *Client) PutMulti(c context.Context,
+	keys []*datastore.Key, vals interface{}) (_ []*datastore.Key, err error) {
+	defer cl.observeLatency(c, "PutMulti", keysKind(keys), time.Now())
+	c, span := cl.startSpan(c, "nds.PutMulti",
+		attribute.Int("nds.keys", len(keys)))
+	defer func() { endSpan(span, err) }()
 
 	if len(keys) == 0 {
 		return nil, nil
@@ -45,7 +61,11 @@ func PutMulti(c context.Context,
 		}
 
 		go func(i int, keys []*datastore.Key, vals reflect.Value) {
-			putKeys[i], errs[i] = putMulti(c, keys, vals.Interface())
+			c, span := cl.startSpan(c, "nds.PutMulti.batch",
+				attribute.Int("nds.batch", i),
+				attribute.Int("nds.keys", len(keys)))
+			putKeys[i], errs[i] = cl.putMulti(c, keys, vals.Interface())
+			endSpan(span, errs[i])
 			wg.Done()
 		}(i, keys[lo:hi], v.Slice(lo, hi))
 	}
@@ -94,16 +114,20 @@ func PutMulti(c context.Context,
 // pointer; if a struct pointer then any unexported fields of that struct will
 // be skipped. If key is an incomplete key, the returned key will be a unique
 // key generated by the datastore.
-func Put(c context.Context,
-	key *datastore.Key, val interface{}) (*datastore.Key, error) {
+func (cl *Client) Put(c context.Context,
+	key *datastore.Key, val interface{}) (_ *datastore.Key, err error) {
 
 	keys := []*datastore.Key{key}
+	defer cl.observeLatency(c, "Put", keysKind(keys), time.Now())
+	c, span := cl.startSpan(c, "nds.Put")
+	defer func() { endSpan(span, err) }()
+
 	vals := []interface{}{val}
 	if err := checkKeysValues(keys, reflect.ValueOf(vals)); err != nil {
 		return nil, err
 	}
 
-	keys, err := putMulti(c, keys, vals)
+	keys, err = cl.putMulti(c, keys, vals)
 	switch e := err.(type) {
 	case nil:
 		return keys[0], nil
@@ -115,14 +139,14 @@ func Put(c context.Context,
 }
 
 // putMulti puts the entities into the datastore and then its local cache.
-func putMulti(c context.Context,
+func (cl *Client) putMulti(c context.Context,
 	keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error) {
 
 	lockMemcacheKeys := make([]string, 0, len(keys))
-	lockMemcacheItems := make([]*memcache.Item, 0, len(keys))
+	lockMemcacheItems := make([]*Item, 0, len(keys))
 	for _, key := range keys {
-		if !key.Incomplete() {
-			item := &memcache.Item{
+		if !key.Incomplete() && !cl.writePolicy(key.Kind).NoCache {
+			item := &Item{
 				Key:        createMemcacheKey(key),
 				Flags:      lockItem,
 				Value:      itemLock(),
@@ -138,12 +162,19 @@ func putMulti(c context.Context,
 		return nil, err
 	}
 
+	// Drop local copies now and again once the write is done in case a
+	// concurrent Get cached the old entity in the meantime.
+	cl.localCache.delete(lockMemcacheKeys)
 	defer func() {
 		if _, ok := transactionFromContext(c); !ok {
+			cl.localCache.delete(lockMemcacheKeys)
+			cl.flights.forget(lockMemcacheKeys)
+
 			// Remove the locks.
-			if err := memcacheDeleteMulti(memcacheCtx,
+			if err := cl.memcacheDeleteMulti(memcacheCtx,
 				lockMemcacheKeys); err != nil {
-				log.Printf("WARNING: putMulti memcache.DeleteMulti %s", err)
+				cl.warn(c, "putMulti", "cache DeleteMulti failed", err,
+					"keys", len(lockMemcacheKeys))
 			}
 		}
 	}()
@@ -152,12 +183,17 @@ func putMulti(c context.Context,
 		tx.Lock()
 		tx.lockMemcacheItems = append(tx.lockMemcacheItems,
 			lockMemcacheItems...)
+		tx.keys = append(tx.keys, keys...)
 		tx.Unlock()
-	} else if err := memcacheSetMulti(memcacheCtx,
-		lockMemcacheItems); err != nil {
+	} else if err := cl.lockCache(memcacheCtx, lockMemcacheItems,
+		keys); err != nil {
 		return nil, err
 	}
 
 	// Save to the datastore.
-	return datastorePutMulti(c, keys, vals)
+	putKeys, err := cl.datastorePutMulti(c, keys, vals)
+	if _, ok := transactionFromContext(c); !ok {
+		cl.invalidateQueries(memcacheCtx, keys)
+	}
+	return putKeys, err
 }
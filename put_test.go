@@ -8,7 +8,6 @@ import (
 	"github.com/yoavfeld/nds"
 	"golang.org/x/net/context"
 	"cloud.google.com/go/datastore"
-	"github.com/bradfitz/gomemcache/memcache"
 )
 
 //var dsClient, _ = datastore.NewClient(context.Background(), "streamrail-qa")
@@ -61,7 +60,7 @@ func TestPutMultiError(t *testing.T) {
 		keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error) {
 		return keys, expectedErrs
 	})
-	defer nds.SetDatastorePutMulti(nds.DsClient.PutMulti)
+	defer nds.SetDatastorePutMulti(nds.DsClient().PutMulti)
 
 	keys := []*datastore.Key{
 		datastore.IDKey("Test", 1, nil),
@@ -162,7 +161,7 @@ func TestPutMultiLockFailure(t *testing.T) {
 	}
 
 	nds.SetMemcacheSetMulti(func(c context.Context,
-		items []*memcache.Item) error {
+		items []*nds.Item) error {
 		return errors.New("expected error")
 	})
 
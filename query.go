@@ -0,0 +1,423 @@
+package nds
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/net/context"
+	"google.golang.org/api/iterator"
+)
+
+// GetAll calls Client.GetAll on the default client.
+func GetAll(c context.Context, q *datastore.Query,
+	dst interface{}) ([]*datastore.Key, error) {
+	return getDefaultClient().GetAll(c, q, dst)
+}
+
+// GetAllWithCursor calls Client.GetAllWithCursor on the default client.
+func GetAllWithCursor(c context.Context, q *datastore.Query,
+	dst interface{}) ([]*datastore.Key, datastore.Cursor, error) {
+	return getDefaultClient().GetAllWithCursor(c, q, dst)
+}
+
+// RunQuery calls Client.RunQuery on the default client.
+func RunQuery(c context.Context, kind, name string,
+	q *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
+	return getDefaultClient().RunQuery(c, kind, name, q, dst)
+}
+
+// GetAll works like datastore.Client.GetAll except that it only queries for
+// the keys q matches. The entities are then loaded with GetMulti, concurrently
+// and from the cache where possible, and appended to dst, which must be a
+// *[]S, *[]*S or *[]P, for some struct type S or some non-interface
+// non-pointer type P such that P or *P implements datastore.PropertyLoadSaver.
+// It returns the keys of the loaded entities in the same order.
+//
+// Entities deleted between the query and the load are left out. If loading
+// any other entity fails, a datastore.MultiError with one error per returned
+// key is returned.
+func (cl *Client) GetAll(c context.Context, q *datastore.Query,
+	dst interface{}) ([]*datastore.Key, error) {
+	keys, _, err := cl.GetAllWithCursor(c, q, dst)
+	return keys, err
+}
+
+// GetAllWithCursor is like GetAll but also returns a cursor positioned after
+// the last result. Pass it to q.Start to get the next page of results.
+func (cl *Client) GetAllWithCursor(c context.Context, q *datastore.Query,
+	dst interface{}) (_ []*datastore.Key, _ datastore.Cursor, err error) {
+	defer cl.observeLatency(c, "GetAllWithCursor", "", time.Now())
+	c, span := cl.startSpan(c, "nds.GetAllWithCursor")
+	defer func() { endSpan(span, err) }()
+
+	dv, err := checkSlicePointer(dst)
+	if err != nil {
+		return nil, datastore.Cursor{}, err
+	}
+
+	keys, cursor, err := cl.runKeysOnly(c, q)
+	if err != nil {
+		return nil, datastore.Cursor{}, err
+	}
+
+	keys, err = cl.loadQueryEntities(c, keys, dv.Elem())
+	return keys, cursor, err
+}
+
+// RunQuery runs q, a query for entities of kind, and appends the entities it
+// matches to dst, which must be a *[]S, *[]*S or *[]P, for some struct type S
+// or some non-interface non-pointer type P such that P or *P implements
+// datastore.PropertyLoadSaver. It returns the keys of the loaded entities in
+// the same order.
+//
+// Only the keys q matches are queried. The entities are then loaded with
+// GetMulti so they come from the cache where possible. Entities deleted since
+// the query ran are left out.
+//
+// If the Client was created with WithQueryCache, the matched keys are also
+// cached under name and q's parameters. Any nds put or delete of an entity of
+// kind invalidates every cached query of that kind, so kind must be the kind
+// q is for. Writes made by other means are only picked up once the cached
+// keys expire. Queries of NoCache kinds are not cached.
+func (cl *Client) RunQuery(c context.Context, kind, name string,
+	q *datastore.Query, dst interface{}) (_ []*datastore.Key, err error) {
+	defer cl.observeLatency(c, "RunQuery", kind, time.Now())
+	c, span := cl.startSpan(c, "nds.RunQuery",
+		attribute.String("nds.kind", kind),
+		attribute.String("nds.query", name))
+	defer func() { endSpan(span, err) }()
+
+	dv, err := checkSlicePointer(dst)
+	if err != nil {
+		return nil, err
+	}
+	if qkind, ok := queryKind(q); ok && qkind != kind {
+		return nil, fmt.Errorf("nds: query is for kind %q, not %q",
+			qkind, kind)
+	}
+
+	keys, err := cl.queryKeys(c, kind, name, q)
+	if err != nil {
+		return nil, err
+	}
+	return cl.loadQueryEntities(c, keys, dv.Elem())
+}
+
+// queryKeys returns the keys q matches, from the cache if possible.
+func (cl *Client) queryKeys(c context.Context, kind, name string,
+	q *datastore.Query) ([]*datastore.Key, error) {
+
+	memcacheCtx, err := memcacheContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	if !cl.queryCache || cl.writePolicy(kind).NoCache ||
+		!cl.cacheReadable(memcacheCtx) {
+		keys, _, err := cl.runKeysOnly(c, q)
+		return keys, err
+	}
+
+	// The generation must be read before the query runs so that results
+	// which might miss a concurrent write are cached under the generation
+	// that write replaces.
+	generation, err := cl.queryGeneration(memcacheCtx, kind)
+	if err != nil {
+		cl.warn(c, "queryKeys", "queryGeneration failed", err, "kind", kind)
+		keys, _, err := cl.runKeysOnly(c, q)
+		return keys, err
+	}
+	memcacheKey := hashMemcacheKey(memcachePrefix + "query:" + kind + ":" +
+		string(generation) + ":" + name + ":" + queryFingerprint(q))
+
+	items, err := cl.memcacheGetMulti(memcacheCtx, []string{memcacheKey})
+	if err != nil {
+		cl.warn(c, "queryKeys", "cache GetMulti failed", err,
+			"kind", kind, "memcache_key", memcacheKey)
+	} else if item, ok := items[memcacheKey]; ok && item.Flags == queryItem {
+		keys, err := decodeKeys(item.Value)
+		if err == nil {
+			return keys, nil
+		}
+		cl.warn(c, "queryKeys", "decodeKeys failed", err,
+			"kind", kind, "memcache_key", memcacheKey)
+	}
+
+	keys, _, err := cl.runKeysOnly(c, q)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if key.Kind != kind {
+			return nil, fmt.Errorf("nds: query returned kind %q, not %q",
+				key.Kind, kind)
+		}
+	}
+
+	item := &Item{
+		Key:        memcacheKey,
+		Flags:      queryItem,
+		Value:      encodeKeys(keys),
+		Expiration: cl.queryCacheTTL,
+	}
+	if err := cl.memcacheSetMulti(memcacheCtx, []*Item{item}); err != nil {
+		cl.warn(c, "queryKeys", "cache SetMulti failed", err,
+			"kind", kind, "memcache_key", memcacheKey)
+	}
+	return keys, nil
+}
+
+// queryKind returns the kind q is for. datastore.Query doesn't export it so it
+// is read by reflection, and ok is false if that isn't possible.
+func queryKind(q *datastore.Query) (kind string, ok bool) {
+	if q == nil {
+		return "", false
+	}
+	v := reflect.ValueOf(q).Elem().FieldByName("kind")
+	if !v.IsValid() || v.Kind() != reflect.String {
+		return "", false
+	}
+	return v.String(), true
+}
+
+var keyPtrType = reflect.TypeOf((*datastore.Key)(nil))
+
+// queryFingerprint describes the parameters of q, so that cached keys are
+// only used for the query that matched them even if its name is reused.
+// datastore.Query doesn't export them so they are read by reflection.
+func queryFingerprint(q *datastore.Query) string {
+	buf := &bytes.Buffer{}
+	writeFingerprint(buf, reflect.ValueOf(q).Elem())
+	return buf.String()
+}
+
+func writeFingerprint(buf *bytes.Buffer, v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Struct:
+		buf.WriteByte('{')
+		for i := 0; i < v.NumField(); i++ {
+			writeFingerprint(buf, v.Field(i))
+			buf.WriteByte(',')
+		}
+		buf.WriteByte('}')
+	case reflect.Slice, reflect.Array:
+		buf.WriteByte('[')
+		for i := 0; i < v.Len(); i++ {
+			writeFingerprint(buf, v.Index(i))
+			buf.WriteByte(',')
+		}
+		buf.WriteByte(']')
+	case reflect.Interface:
+		if !v.IsNil() {
+			buf.WriteString(v.Elem().Type().String() + ":")
+			writeFingerprint(buf, v.Elem())
+		}
+	case reflect.Ptr:
+		// Keys are described by value. Other pointers, such as a
+		// transaction, only by whether they are set.
+		switch {
+		case v.IsNil():
+			buf.WriteString("nil")
+		case v.Type() == keyPtrType:
+			writeFingerprint(buf, v.Elem())
+		default:
+			buf.WriteString("ptr")
+		}
+	case reflect.String:
+		buf.WriteString(strconv.Quote(v.String()))
+	case reflect.Bool:
+		buf.WriteString(strconv.FormatBool(v.Bool()))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64:
+		buf.WriteString(strconv.FormatInt(v.Int(), 10))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+		buf.WriteString(strconv.FormatUint(v.Uint(), 10))
+	case reflect.Float32, reflect.Float64:
+		buf.WriteString(strconv.FormatFloat(v.Float(), 'g', -1, 64))
+	default:
+		buf.WriteString(v.Type().String())
+	}
+}
+
+// runKeysOnly pages through the keys q matches and returns them with a cursor
+// positioned after the last one.
+func (cl *Client) runKeysOnly(c context.Context,
+	q *datastore.Query) ([]*datastore.Key, datastore.Cursor, error) {
+
+	keys := []*datastore.Key{}
+	it := cl.ds.Run(c, q.KeysOnly())
+	for {
+		key, err := it.Next(nil)
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, datastore.Cursor{}, err
+		}
+		keys = append(keys, key)
+	}
+
+	cursor, err := it.Cursor()
+	if err != nil {
+		return nil, datastore.Cursor{}, err
+	}
+	return keys, cursor, nil
+}
+
+// loadQueryEntities gets the entities for keys and appends them to the slice
+// dst. Keys of entities that no longer exist are dropped.
+func (cl *Client) loadQueryEntities(c context.Context,
+	keys []*datastore.Key, dst reflect.Value) ([]*datastore.Key, error) {
+
+	if len(keys) == 0 {
+		return keys, nil
+	}
+
+	vals := reflect.MakeSlice(dst.Type(), len(keys), len(keys))
+	err := cl.GetMulti(c, keys, vals.Interface())
+	me, ok := err.(datastore.MultiError)
+	if err != nil && !ok {
+		return nil, err
+	}
+
+	loadedKeys := make([]*datastore.Key, 0, len(keys))
+	loadedErrs, errsNil := make(datastore.MultiError, 0, len(keys)), true
+	for i, key := range keys {
+		if me != nil {
+			if me[i] == datastore.ErrNoSuchEntity {
+				continue
+			}
+			if me[i] != nil {
+				errsNil = false
+			}
+			loadedErrs = append(loadedErrs, me[i])
+		}
+		loadedKeys = append(loadedKeys, key)
+		dst.Set(reflect.Append(dst, vals.Index(i)))
+	}
+
+	if errsNil {
+		return loadedKeys, nil
+	}
+	return loadedKeys, loadedErrs
+}
+
+func checkSlicePointer(dst interface{}) (reflect.Value, error) {
+	dv := reflect.ValueOf(dst)
+	if dv.Kind() != reflect.Ptr || dv.IsNil() ||
+		dv.Elem().Kind() != reflect.Slice {
+		return reflect.Value{}, errors.New("nds: dst is not a slice pointer")
+	}
+	return dv, nil
+}
+
+// queryGeneration returns the current query generation of kind, starting one
+// if there is none.
+func (cl *Client) queryGeneration(c context.Context,
+	kind string) ([]byte, error) {
+
+	memcacheKey := createGenerationMemcacheKey(kind)
+	for i := 0; i < 2; i++ {
+		items, err := cl.memcacheGetMulti(c, []string{memcacheKey})
+		if err != nil {
+			return nil, err
+		}
+		if item, ok := items[memcacheKey]; ok {
+			return item.Value, nil
+		}
+
+		// If a concurrent call beats us to it we read its generation.
+		item := &Item{
+			Key:   memcacheKey,
+			Flags: generationItem,
+			Value: newGeneration(),
+		}
+		if err := cl.memcacheAddMulti(c, []*Item{item}); err == nil {
+			return item.Value, nil
+		}
+	}
+	return nil, errors.New("nds: no query generation for kind " + kind)
+}
+
+// invalidateQueries starts a new query generation for the kind of each key so
+// that RunQuery stops using keys it cached before the entities were written.
+// Writes also start one in lockCache before they are made, so a failure here
+// only costs the queries cached while the write ran.
+func (cl *Client) invalidateQueries(c context.Context, keys []*datastore.Key) {
+	items := cl.generationItems(keys)
+	if len(items) == 0 {
+		return
+	}
+
+	if err := cl.memcacheSetMulti(c, items); err != nil {
+		cl.warn(c, "invalidateQueries", "cache SetMulti failed", err,
+			"kinds", len(items))
+	}
+}
+
+// generationItems returns new query generations for the kinds of keys, or
+// none if queries are not cached. NoCache kinds have no cached queries.
+func (cl *Client) generationItems(keys []*datastore.Key) []*Item {
+	if !cl.queryCache {
+		return nil
+	}
+
+	kinds := map[string]bool{}
+	items := make([]*Item, 0, 1)
+	for _, key := range keys {
+		if key == nil || kinds[key.Kind] ||
+			cl.writePolicy(key.Kind).NoCache {
+			continue
+		}
+		kinds[key.Kind] = true
+		items = append(items, &Item{
+			Key:   createGenerationMemcacheKey(key.Kind),
+			Flags: generationItem,
+			Value: newGeneration(),
+		})
+	}
+	return items
+}
+
+func createGenerationMemcacheKey(kind string) string {
+	return hashMemcacheKey(memcachePrefix + "generation:" + kind)
+}
+
+func newGeneration() []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(rand.Int63()))
+	return b
+}
+
+func encodeKeys(keys []*datastore.Key) []byte {
+	encoded := make([]string, len(keys))
+	for i, key := range keys {
+		encoded[i] = key.Encode()
+	}
+	return []byte(strings.Join(encoded, "\n"))
+}
+
+func decodeKeys(data []byte) ([]*datastore.Key, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	encoded := strings.Split(string(data), "\n")
+	keys := make([]*datastore.Key, len(encoded))
+	for i, s := range encoded {
+		key, err := datastore.DecodeKey(s)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = key
+	}
+	return keys, nil
+}
@@ -0,0 +1,360 @@
+package nds_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/yoavfeld/nds"
+
+	"cloud.google.com/go/datastore"
+	"golang.org/x/net/context"
+)
+
+func TestRunQuery(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	parent := datastore.NameKey("QueryParent", "runquery", nil)
+	keys := []*datastore.Key{
+		datastore.IDKey("QueryEntity", 1, parent),
+		datastore.IDKey("QueryEntity", 2, parent),
+	}
+	if _, err := nds.PutMulti(c, keys, []testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	q := datastore.NewQuery("QueryEntity").Ancestor(parent)
+	var entities []testEntity
+	gotKeys, err := nds.RunQuery(c, "QueryEntity", "runquery", q, &entities)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gotKeys) != 2 || len(entities) != 2 {
+		t.Fatal("expected 2 entities", len(gotKeys), len(entities))
+	}
+	for i, entity := range entities {
+		if !gotKeys[i].Equal(keys[i]) || entity.Val != i+1 {
+			t.Fatal("incorrect entity", gotKeys[i], entity.Val)
+		}
+	}
+
+	// Deleted entities are left out.
+	if err := nds.Delete(c, keys[0]); err != nil {
+		t.Fatal(err)
+	}
+	entities = nil
+	if gotKeys, err = nds.RunQuery(c, "QueryEntity", "runquery", q,
+		&entities); err != nil {
+		t.Fatal(err)
+	}
+	if len(gotKeys) != 1 || len(entities) != 1 || entities[0].Val != 2 {
+		t.Fatal("expected 1 entity", len(gotKeys), len(entities))
+	}
+
+	if _, err := nds.RunQuery(c, "QueryEntity", "runquery", q,
+		entities); err == nil {
+		t.Fatal("expected slice pointer error")
+	}
+}
+
+func TestRunQueryCache(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	cl, err := nds.NewClient(nds.DsClient(), nds.WithCache(newMemoryCache()),
+		nds.WithQueryCache(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parent := datastore.NameKey("QueryParent", "runquerycache", nil)
+	keys := []*datastore.Key{
+		datastore.IDKey("QueryEntity", 1, parent),
+		datastore.IDKey("QueryEntity", 2, parent),
+		datastore.IDKey("QueryEntity", 3, parent),
+	}
+	if err := cl.DeleteMulti(c, keys); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cl.Put(c, keys[0], &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	q := datastore.NewQuery("QueryEntity").Ancestor(parent)
+	runQuery := func() []testEntity {
+		var entities []testEntity
+		if _, err := cl.RunQuery(c, "QueryEntity", "runquerycache", q,
+			&entities); err != nil {
+			t.Fatal(err)
+		}
+		return entities
+	}
+
+	if entities := runQuery(); len(entities) != 1 {
+		t.Fatal("expected 1 entity", len(entities))
+	}
+
+	// Writes that bypass nds are not seen until the cached keys expire.
+	if _, err := nds.DsClient().Put(c, keys[1], &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+	if entities := runQuery(); len(entities) != 1 {
+		t.Fatal("expected cached query", len(entities))
+	}
+
+	// An nds write of the same kind invalidates the cached keys.
+	if _, err := cl.Put(c, keys[2], &testEntity{3}); err != nil {
+		t.Fatal(err)
+	}
+	if entities := runQuery(); len(entities) != 3 {
+		t.Fatal("expected 3 entities", len(entities))
+	}
+
+	// So does a transaction.
+	if _, err := cl.RunInTransaction(c, func(tx *nds.Transaction) error {
+		return tx.Delete(keys[1])
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if entities := runQuery(); len(entities) != 2 {
+		t.Fatal("expected 2 entities", len(entities))
+	}
+}
+
+// generationFailingCache is a memoryCache that fails SetMulti calls that
+// only start new query generations, such as the ones made after writes.
+type generationFailingCache struct {
+	*memoryCache
+}
+
+func (gc *generationFailingCache) SetMulti(c context.Context,
+	items []*nds.Item) error {
+	for _, item := range items {
+		if item.Flags != nds.GenerationItem {
+			return gc.memoryCache.SetMulti(c, items)
+		}
+	}
+	return errors.New("generation not stored")
+}
+
+// itemFailingCache is a memoryCache whose SetMulti fails the items with the
+// flags in fail, reporting an error per item as some backends do.
+type itemFailingCache struct {
+	*memoryCache
+	fail map[uint32]bool
+}
+
+func (ic *itemFailingCache) SetMulti(c context.Context,
+	items []*nds.Item) error {
+	me := make(datastore.MultiError, len(items))
+	stored := []*nds.Item{}
+	for i, item := range items {
+		if ic.fail[item.Flags] {
+			me[i] = errors.New("item not stored")
+		} else {
+			stored = append(stored, item)
+		}
+	}
+	if err := ic.memoryCache.SetMulti(c, stored); err != nil {
+		return err
+	}
+	for _, err := range me {
+		if err != nil {
+			return me
+		}
+	}
+	return nil
+}
+
+func TestQueryCacheLockFailure(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	cache := &itemFailingCache{
+		memoryCache: newMemoryCache(),
+		fail:        map[uint32]bool{nds.GenerationItem: true},
+	}
+	cl, err := nds.NewClient(nds.DsClient(), nds.WithCache(cache),
+		nds.WithQueryCache(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := datastore.IDKey("QueryEntity", 1,
+		datastore.NameKey("QueryParent", "lockfailure", nil))
+
+	// Writes whose query generation isn't stored must not be made.
+	if _, err := cl.Put(c, key, &testEntity{1}); err == nil {
+		t.Fatal("expected the put to fail")
+	}
+	if err := nds.DsClient().Get(c, key,
+		&testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected the put not to be made", err)
+	}
+	if _, err := nds.DsClient().Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Delete(c, key); err == nil {
+		t.Fatal("expected the delete to fail")
+	}
+	if err := nds.DsClient().Get(c, key, &testEntity{}); err != nil {
+		t.Fatal("expected the delete not to be made", err)
+	}
+
+	// Nor when every item fails.
+	cache.fail[nds.LockItem] = true
+	if _, err := cl.PutMulti(c, []*datastore.Key{key},
+		[]testEntity{{2}}); err == nil {
+		t.Fatal("expected the put to fail")
+	}
+	if err := cl.DeleteMulti(c, []*datastore.Key{key}); err == nil {
+		t.Fatal("expected the delete to fail")
+	}
+}
+
+func TestRunQueryCacheInvalidation(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	cl, err := nds.NewClient(nds.DsClient(),
+		nds.WithCache(&generationFailingCache{newMemoryCache()}),
+		nds.WithQueryCache(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parents := []*datastore.Key{
+		datastore.NameKey("QueryParent", "invalidation1", nil),
+		datastore.NameKey("QueryParent", "invalidation2", nil),
+	}
+	keys := []*datastore.Key{
+		datastore.IDKey("QueryEntity", 1, parents[0]),
+		datastore.IDKey("QueryEntity", 2, parents[0]),
+		datastore.IDKey("QueryEntity", 1, parents[1]),
+	}
+	if err := cl.DeleteMulti(c, keys); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cl.PutMulti(c, []*datastore.Key{keys[0], keys[2]},
+		[]testEntity{{1}, {3}}); err != nil {
+		t.Fatal(err)
+	}
+
+	runQuery := func(parent *datastore.Key) []testEntity {
+		q := datastore.NewQuery("QueryEntity").Ancestor(parent)
+		var entities []testEntity
+		if _, err := cl.RunQuery(c, "QueryEntity", "invalidation", q,
+			&entities); err != nil {
+			t.Fatal(err)
+		}
+		return entities
+	}
+
+	if entities := runQuery(parents[0]); len(entities) != 1 {
+		t.Fatal("expected 1 entity", len(entities))
+	}
+
+	// A name reused for another query doesn't get the first query's keys.
+	if entities := runQuery(parents[1]); len(entities) != 1 ||
+		entities[0].Val != 3 {
+		t.Fatal("expected the other query's entity", entities)
+	}
+
+	// Cached keys are invalidated before a write, so a write whose later
+	// invalidation fails is still seen.
+	if _, err := cl.Put(c, keys[1], &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+	if entities := runQuery(parents[0]); len(entities) != 2 {
+		t.Fatal("expected 2 entities", len(entities))
+	}
+
+	// The kind must be the query's.
+	q := datastore.NewQuery("QueryEntity").Ancestor(parents[0])
+	var entities []testEntity
+	if _, err := cl.RunQuery(c, "OtherEntity", "invalidation", q,
+		&entities); err == nil {
+		t.Fatal("expected kind mismatch error")
+	}
+}
+
+func TestGetAll(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	parent := datastore.NameKey("QueryParent", "getall", nil)
+	keys := make([]*datastore.Key, 5)
+	entities := make([]testEntity, len(keys))
+	for i := range keys {
+		keys[i] = datastore.IDKey("QueryEntity", int64(i+1), parent)
+		entities[i] = testEntity{i + 1}
+	}
+	if _, err := nds.PutMulti(c, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+
+	q := datastore.NewQuery("QueryEntity").Ancestor(parent)
+	var got []*testEntity
+	gotKeys, err := nds.GetAll(c, q, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gotKeys) != len(keys) || len(got) != len(keys) {
+		t.Fatal("incorrect length", len(gotKeys), len(got))
+	}
+	for i := range got {
+		if !gotKeys[i].Equal(keys[i]) || got[i].Val != i+1 {
+			t.Fatal("incorrect entity", gotKeys[i], got[i].Val)
+		}
+	}
+
+	// Page through with cursors.
+	var paged []testEntity
+	pageQuery := q.Limit(2)
+	for page := 0; ; page++ {
+		if page > len(keys) {
+			t.Fatal("too many pages")
+		}
+		pageKeys, cursor, err := nds.GetAllWithCursor(c, pageQuery, &paged)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pageKeys) == 0 {
+			break
+		}
+		pageQuery = q.Limit(2).Start(cursor)
+	}
+	if len(paged) != len(keys) {
+		t.Fatal("incorrect paged length", len(paged))
+	}
+	for i, entity := range paged {
+		if entity.Val != i+1 {
+			t.Fatal("incorrect paged entity", entity.Val)
+		}
+	}
+
+	if _, err := nds.GetAll(c, q, got); err == nil {
+		t.Fatal("expected slice pointer error")
+	}
+}
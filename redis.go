@@ -0,0 +1,186 @@
+package nds
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/net/context"
+)
+
+// redisFlagsSize is the number of bytes at the start of every redis value that
+// hold the item flags, as redis has no native equivalent.
+const redisFlagsSize = 4
+
+var (
+	errRedisNotStored   = errors.New("nds: redis item not stored")
+	errRedisCASConflict = errors.New("nds: redis compare-and-swap conflict")
+	errRedisMalformed   = errors.New("nds: malformed redis item")
+)
+
+// redisCompareAndSwap atomically replaces the value at KEYS[1] with ARGV[2]
+// only if it still holds ARGV[1], the value GetMulti returned. As lock items
+// carry the value generated by itemLock, this only succeeds for the caller
+// that owns the lock. ARGV[3] is the expiration in milliseconds, 0 for none.
+var redisCompareAndSwap = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return false
+end
+if tonumber(ARGV[3]) > 0 then
+	return redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+end
+return redis.call('SET', KEYS[1], ARGV[2])
+`)
+
+// redisClient is a Cache that stores items in redis.
+type redisClient struct {
+	client redis.UniversalClient
+}
+
+// NewRedis creates a Cache that stores items in redis through client. It
+// provides the same consistency guarantees as the memcache Cache.
+func NewRedis(client redis.UniversalClient) Cache {
+	return &redisClient{client}
+}
+
+func encodeRedisValue(item *Item) []byte {
+	value := make([]byte, redisFlagsSize+len(item.Value))
+	binary.LittleEndian.PutUint32(value, item.Flags)
+	copy(value[redisFlagsSize:], item.Value)
+	return value
+}
+
+// redisMilliseconds converts d into a redis expiration, rounding up so that
+// expirations under a millisecond don't become none.
+func redisMilliseconds(d time.Duration) int64 {
+	return int64((d + time.Millisecond - 1) / time.Millisecond)
+}
+
+// redisErrors converts the results of a pipeline into the error a Cache
+// method returns. A redis.Nil result is reported as nilErr.
+func redisErrors(cmds []redis.Cmder, nilErr error) error {
+	multiErr, any := make(datastore.MultiError, len(cmds)), false
+	for i, cmd := range cmds {
+		switch err := cmd.Err(); err {
+		case nil:
+		case redis.Nil:
+			multiErr[i] = nilErr
+			any = true
+		default:
+			multiErr[i] = err
+			any = true
+		}
+	}
+	if any {
+		return multiErr
+	}
+	return nil
+}
+
+func (rc *redisClient) AddMulti(c context.Context, items []*Item) error {
+	pipe := rc.client.Pipeline()
+	cmds := make([]redis.Cmder, len(items))
+	for i, item := range items {
+		args := []interface{}{"SET", item.Key, encodeRedisValue(item)}
+		if item.Expiration > 0 {
+			args = append(args, "PX", redisMilliseconds(item.Expiration))
+		}
+		cmds[i] = pipe.Do(c, append(args, "NX")...)
+	}
+	// Errors are reported per command below.
+	pipe.Exec(c)
+	return redisErrors(cmds, errRedisNotStored)
+}
+
+func (rc *redisClient) SetMulti(c context.Context, items []*Item) error {
+	pipe := rc.client.Pipeline()
+	cmds := make([]redis.Cmder, len(items))
+	for i, item := range items {
+		cmds[i] = pipe.Set(c, item.Key, encodeRedisValue(item),
+			item.Expiration)
+	}
+	pipe.Exec(c)
+	return redisErrors(cmds, errRedisNotStored)
+}
+
+func (rc *redisClient) GetMulti(c context.Context,
+	keys []string) (map[string]*Item, error) {
+
+	pipe := rc.client.Pipeline()
+	cmds := make([]*redis.StringCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.Get(c, key)
+	}
+	pipe.Exec(c)
+
+	items := make(map[string]*Item, len(keys))
+	for i, cmd := range cmds {
+		value, err := cmd.Result()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if len(value) < redisFlagsSize {
+			return nil, errRedisMalformed
+		}
+		items[keys[i]] = &Item{
+			Key:     keys[i],
+			Value:   []byte(value[redisFlagsSize:]),
+			Flags:   binary.LittleEndian.Uint32([]byte(value)),
+			casInfo: value,
+		}
+	}
+	return items, nil
+}
+
+func (rc *redisClient) DeleteMulti(c context.Context, keys []string) error {
+	pipe := rc.client.Pipeline()
+	cmds := make([]redis.Cmder, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.Del(c, key)
+	}
+	pipe.Exec(c)
+	return redisErrors(cmds, nil)
+}
+
+func (rc *redisClient) CompareAndSwapMulti(c context.Context,
+	items []*Item) error {
+
+	pipe := rc.client.Pipeline()
+	cmds := make([]redis.Cmder, len(items))
+	multiErr, any := make(datastore.MultiError, len(items)), false
+	for i, item := range items {
+		old, ok := item.casInfo.(string)
+		if !ok {
+			multiErr[i] = errRedisCASConflict
+			any = true
+			continue
+		}
+		cmds[i] = redisCompareAndSwap.Eval(c, pipe, []string{item.Key},
+			old, encodeRedisValue(item),
+			redisMilliseconds(item.Expiration))
+	}
+	pipe.Exec(c)
+
+	for i, cmd := range cmds {
+		if cmd == nil {
+			continue
+		}
+		switch err := cmd.Err(); err {
+		case nil:
+		case redis.Nil:
+			multiErr[i] = errRedisCASConflict
+			any = true
+		default:
+			multiErr[i] = err
+			any = true
+		}
+	}
+	if any {
+		return multiErr
+	}
+	return nil
+}
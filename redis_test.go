@@ -0,0 +1,192 @@
+package nds_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/yoavfeld/nds"
+
+	"cloud.google.com/go/datastore"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newRedisCache(t *testing.T) (nds.Cache, *miniredis.Miniredis) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nds.NewRedis(redis.NewClient(&redis.Options{Addr: mr.Addr()})), mr
+}
+
+func TestRedisAddMulti(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	cache, mr := newRedisCache(t)
+	defer mr.Close()
+
+	items := []*nds.Item{
+		{Key: "one", Value: []byte{1}, Flags: nds.LockItem,
+			Expiration: 32 * time.Second},
+		{Key: "two", Value: []byte{2}, Flags: nds.EntityItem},
+	}
+	if err := cache.AddMulti(c, items); err != nil {
+		t.Fatal(err)
+	}
+
+	// Adding again must fail for every item.
+	err := cache.AddMulti(c, items)
+	me, ok := err.(datastore.MultiError)
+	if !ok {
+		t.Fatal("expected datastore.MultiError", err)
+	}
+	for _, e := range me {
+		if e == nil {
+			t.Fatal("expected add error")
+		}
+	}
+
+	got, err := cache.GetMulti(c, []string{"one", "two", "three"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatal("expected 2 items", len(got))
+	}
+	for _, item := range items {
+		if got[item.Key].Flags != item.Flags {
+			t.Fatal("incorrect flags", got[item.Key].Flags)
+		}
+		if string(got[item.Key].Value) != string(item.Value) {
+			t.Fatal("incorrect value", got[item.Key].Value)
+		}
+	}
+
+	// The lock item expires.
+	mr.FastForward(33 * time.Second)
+	got, err = cache.GetMulti(c, []string{"one", "two"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := got["one"]; ok {
+		t.Fatal("expected lock item to expire")
+	}
+	if _, ok := got["two"]; !ok {
+		t.Fatal("expected entity item to remain")
+	}
+}
+
+func TestRedisCompareAndSwapMulti(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	cache, mr := newRedisCache(t)
+	defer mr.Close()
+
+	lock := &nds.Item{Key: "key", Value: []byte{1, 2, 3, 4},
+		Flags: nds.LockItem}
+	if err := cache.AddMulti(c, []*nds.Item{lock}); err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := cache.GetMulti(c, []string{"key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	item := items["key"]
+
+	// Another caller replaces the lock so our swap must fail.
+	if err := cache.SetMulti(c, []*nds.Item{{Key: "key",
+		Value: []byte{5, 6, 7, 8}, Flags: nds.LockItem}}); err != nil {
+		t.Fatal(err)
+	}
+	item.Flags = nds.EntityItem
+	item.Value = []byte("entity")
+	if err := cache.CompareAndSwapMulti(c, []*nds.Item{item}); err == nil {
+		t.Fatal("expected compare-and-swap conflict")
+	}
+
+	// Items that did not come from GetMulti can't be swapped.
+	if err := cache.CompareAndSwapMulti(c, []*nds.Item{{Key: "key",
+		Value: []byte("entity"), Flags: nds.EntityItem}}); err == nil {
+		t.Fatal("expected compare-and-swap conflict")
+	}
+
+	items, err = cache.GetMulti(c, []string{"key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	item = items["key"]
+	item.Flags = nds.EntityItem
+	item.Value = []byte("entity")
+	item.Expiration = 500 * time.Microsecond
+	if err := cache.CompareAndSwapMulti(c, []*nds.Item{item}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Expirations under a millisecond round up rather than to none.
+	if ttl := mr.TTL("key"); ttl <= 0 {
+		t.Fatal("expected an expiration", ttl)
+	}
+
+	items, err = cache.GetMulti(c, []string{"key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if items["key"].Flags != nds.EntityItem ||
+		string(items["key"].Value) != "entity" {
+		t.Fatal("incorrect item", items["key"])
+	}
+
+	if err := cache.DeleteMulti(c, []string{"key"}); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists("key") {
+		t.Fatal("expected key to be deleted")
+	}
+}
+
+func TestRedisClientPutGetDelete(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	cache, mr := newRedisCache(t)
+	defer mr.Close()
+
+	cl, err := nds.NewClient(nds.DsClient(), nds.WithCache(cache))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := datastore.IDKey("Entity", 1, nil)
+	if _, err := cl.Put(c, key, &testEntity{42}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Get from datastore, then from redis.
+	for i := 0; i < 2; i++ {
+		te := &testEntity{}
+		if err := cl.Get(c, key, te); err != nil {
+			t.Fatal(err)
+		}
+		if te.IntVal != 42 {
+			t.Fatal("te.IntVal != 42", te.IntVal)
+		}
+	}
+
+	if !mr.Exists(nds.CreateMemcacheKey(key)) {
+		t.Fatal("expected entity in redis")
+	}
+
+	if err := cl.Delete(c, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Get(c, key, &testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity")
+	}
+}
@@ -0,0 +1,76 @@
+package nds
+
+import (
+	"cloud.google.com/go/datastore"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+)
+
+// tracerName is the instrumentation name of the spans nds creates.
+const tracerName = "github.com/yoavfeld/nds"
+
+// WithTracerProvider makes the Client trace its calls with a tracer from tp.
+// Every public call gets a span, with a child span per datastore batch and
+// per cache phase of each batch. Spans are children of the span in the
+// context passed to the call.
+func WithTracerProvider(tp trace.TracerProvider) ClientOption {
+	return func(cl *Client) {
+		cl.tracer = tp.Tracer(tracerName)
+	}
+}
+
+// startSpan starts a span named name as a child of the span in c. If the
+// Client has no tracer the returned span does nothing.
+func (cl *Client) startSpan(c context.Context, name string,
+	attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if cl.tracer == nil {
+		// The span of an empty context is a no-op span.
+		return c, trace.SpanFromContext(context.Background())
+	}
+	return cl.tracer.Start(c, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends span, recording err on it. Per entity errors in a
+// datastore.MultiError, which include expected ones such as
+// datastore.ErrNoSuchEntity, are only counted.
+func endSpan(span trace.Span, err error) {
+	if me, ok := err.(datastore.MultiError); ok {
+		errs := 0
+		for _, e := range me {
+			if e != nil {
+				errs++
+			}
+		}
+		span.SetAttributes(attribute.Int("nds.errors", errs))
+	} else if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracePhase runs phase in a span named name and records on it how many
+// cacheItems are in each cache state afterwards.
+func (cl *Client) tracePhase(c context.Context, name string,
+	cacheItems []cacheItem, phase func(c context.Context) error) error {
+
+	c, span := cl.startSpan(c, name)
+	err := phase(c)
+	if span.IsRecording() {
+		states := map[cacheState]int{}
+		for _, cacheItem := range cacheItems {
+			states[cacheItem.state]++
+		}
+		span.SetAttributes(
+			attribute.Int("nds.keys", len(cacheItems)),
+			attribute.Int("nds.done", states[done]),
+			attribute.Int("nds.miss", states[miss]),
+			attribute.Int("nds.internal_lock", states[internalLock]),
+			attribute.Int("nds.external_lock", states[externalLock]),
+			attribute.Int("nds.bypass", states[bypass]))
+	}
+	endSpan(span, err)
+	return err
+}
@@ -0,0 +1,102 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/yoavfeld/nds"
+
+	"cloud.google.com/go/datastore"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestClientWithTracerProvider(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	cl, err := nds.NewClient(nds.DsClient(), nds.WithCache(newMemoryCache()),
+		nds.WithTracerProvider(tp))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []*datastore.Key{
+		datastore.IDKey("TraceEntity", 1, nil),
+		datastore.IDKey("TraceEntity", 2, nil),
+	}
+	if _, err := cl.PutMulti(c, keys, []testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+	// Cache the entities so the traced call below hits.
+	if err := cl.GetMulti(c, keys, make([]testEntity, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.GetMulti(c, keys, make([]testEntity, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := recorder.Ended()
+	byName := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range spans {
+		// Keep the spans of the last call.
+		byName[span.Name()] = span
+	}
+
+	call, ok := byName["nds.GetMulti"]
+	if !ok {
+		t.Fatal("expected nds.GetMulti span")
+	}
+	batch, ok := byName["nds.GetMulti.batch"]
+	if !ok || batch.Parent().SpanID() != call.SpanContext().SpanID() {
+		t.Fatal("expected batch span to be a child of the call span")
+	}
+	for _, name := range []string{
+		"nds.loadLocalCache",
+		"nds.loadMemcache",
+		"nds.lockMemcache",
+		"nds.loadDatastore",
+		"nds.saveMemcache",
+	} {
+		phase, ok := byName[name]
+		if !ok || phase.Parent().SpanID() != batch.SpanContext().SpanID() {
+			t.Fatal("expected phase span to be a child of the batch span",
+				name)
+		}
+	}
+
+	done := int64(-1)
+	for _, attr := range byName["nds.loadMemcache"].Attributes() {
+		if attr.Key == "nds.done" {
+			done = attr.Value.AsInt64()
+		}
+	}
+	if done != 2 {
+		t.Fatal("expected 2 cache hits", done)
+	}
+
+	if _, ok := byName["nds.PutMulti.batch"]; !ok {
+		t.Fatal("expected nds.PutMulti.batch span")
+	}
+
+	// Single writes get a span of their own too.
+	if _, err := cl.Put(c, keys[0], &testEntity{3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Delete(c, keys[1]); err != nil {
+		t.Fatal(err)
+	}
+	for _, span := range recorder.Ended() {
+		byName[span.Name()] = span
+	}
+	for _, name := range []string{"nds.Put", "nds.Delete"} {
+		if _, ok := byName[name]; !ok {
+			t.Fatal("expected span", name)
+		}
+	}
+}
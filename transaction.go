@@ -2,60 +2,75 @@ package nds
 
 import (
 	"sync"
+	"time"
 
 	"golang.org/x/net/context"
 	"cloud.google.com/go/datastore"
-	"github.com/bradfitz/gomemcache/memcache"
 )
 
-var transactionKey = "used for *transaction"
+var transactionKey = "used for *Transaction"
 
-type transaction struct {
+// Transaction is a datastore transaction that keeps the cache consistent
+// with the entities it writes. Create one with NewTransaction or use
+// RunInTransaction.
+type Transaction struct {
 	sync.Mutex
-	tx *datastore.Transaction
-	lockMemcacheItems []*memcache.Item
+	client            *Client
+	ctx               context.Context
+	tx                *datastore.Transaction
+	lockMemcacheItems []*Item
+
+	// keys are the keys of every entity written in the transaction.
+	keys []*datastore.Key
 }
 
-func transactionFromContext(c context.Context) (*transaction, bool) {
-	tx, ok := c.Value(&transactionKey).(*transaction)
+func transactionFromContext(c context.Context) (*Transaction, bool) {
+	tx, ok := c.Value(&transactionKey).(*Transaction)
 	return tx, ok
 }
 
+// newTransaction wraps tx and stores the result in the context it uses for
+// cache calls.
+func (cl *Client) newTransaction(c context.Context,
+	tx *datastore.Transaction) *Transaction {
+	t := &Transaction{client: cl, tx: tx}
+	t.ctx = context.WithValue(c, &transactionKey, t)
+	return t
+}
+
+// NewTransaction calls Client.NewTransaction on the default client.
+func NewTransaction(c context.Context,
+	opts ...datastore.TransactionOption) (*Transaction, error) {
+	return getDefaultClient().NewTransaction(c, opts...)
+}
+
+// RunInTransaction calls Client.RunInTransaction on the default client.
+func RunInTransaction(c context.Context, f func(tx *Transaction) error,
+	opts ...datastore.TransactionOption) (*datastore.Commit, error) {
+	return getDefaultClient().RunInTransaction(c, f, opts...)
+}
 
 // NewTransaction starts a new transaction.
-//func NewTransaction(ctx context.Context, opts ...TransactionOption) (*Transaction, error) {
-//	for _, o := range opts {
-//		if _, ok := o.(maxAttempts); ok {
-//			return nil, errors.New("datastore: NewTransaction does not accept MaxAttempts option")
-//		}
-//	}
-//	req := &pb.BeginTransactionRequest{
-//		ProjectId: c.dataset,
-//	}
-//	resp, err := c.client.BeginTransaction(ctx, req)
-//	if err != nil {
-//		return nil, err
-//	}
-//
-//	return &Transaction{
-//		id:        resp.Transaction,
-//		ctx:       ctx,
-//		client:    c,
-//		mutations: nil,
-//		pending:   make(map[int]*PendingKey),
-//	}, nil
-//}
+func (cl *Client) NewTransaction(c context.Context,
+	opts ...datastore.TransactionOption) (*Transaction, error) {
+	tx, err := cl.ds.NewTransaction(c, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return cl.newTransaction(c, tx), nil
+}
 
 // RunInTransaction runs f in a transaction. f is invoked with a Transaction
 // that f should use for all the transaction's datastore operations.
 //
 // f must not call Commit or Rollback on the provided Transaction.
 //
-// If f returns nil, RunInTransaction commits the transaction,
-// returning the Commit and a nil error if it succeeds. If the commit fails due
-// to a conflicting transaction, RunInTransaction retries f with a new
-// Transaction. It gives up and returns ErrConcurrentTransaction after three
-// failed attempts (or as configured with MaxAttempts).
+// If f returns nil, RunInTransaction locks the cache items of every entity
+// written by f and commits the transaction, returning the Commit and a nil
+// error if it succeeds. If the commit fails due to a conflicting transaction,
+// RunInTransaction retries f with a new Transaction. It gives up and returns
+// datastore.ErrConcurrentTransaction after three failed attempts (or as
+// configured with datastore.MaxAttempts).
 //
 // If f returns non-nil, then the transaction will be rolled back and
 // RunInTransaction will return the same error. The function f is not retried.
@@ -68,34 +83,94 @@ func transactionFromContext(c context.Context) (*transaction, bool) {
 // is, it should have the same result when called multiple times. Note that
 // Transaction.Get will append when unmarshalling slice fields, so it is not
 // necessarily idempotent.
-//func RunInTransaction(ctx context.Context, f func(tx *Transaction) error, opts ...TransactionOption) (*Commit, error) {
-//	settings := newTransactionSettings(opts)
-//	for n := 0; n < settings.attempts; n++ {
-//		tx, err := c.NewTransaction(ctx)
-//		if err != nil {
-//			return nil, err
-//		}
-//		if err := f(tx); err != nil {
-//			tx.Rollback()
-//			return nil, err
-//		}
-//		if cmt, err := tx.Commit(); err != ErrConcurrentTransaction {
-//			return cmt, err
-//		}
-//	}
-//	return nil, ErrConcurrentTransaction
-//}
+func (cl *Client) RunInTransaction(c context.Context,
+	f func(tx *Transaction) error,
+	opts ...datastore.TransactionOption) (_ *datastore.Commit, err error) {
+
+	defer cl.observeLatency(c, "RunInTransaction", "", time.Now())
+	c, span := cl.startSpan(c, "nds.RunInTransaction")
+	defer func() { endSpan(span, err) }()
+
+	var t *Transaction
+	commit, err := cl.ds.RunInTransaction(c,
+		func(tx *datastore.Transaction) error {
+			t = cl.newTransaction(c, tx)
+			if err := f(t); err != nil {
+				return err
+			}
+
+			// The datastore commits as soon as we return so the cache must
+			// be locked now. Returning an error rolls the transaction back.
+			t.Lock()
+			defer t.Unlock()
+			return t.lockMemcache()
+		}, opts...)
+
+	if t != nil {
+		cl.localCache.delete(t.lockMemcacheKeys())
+		cl.flights.forget(t.lockMemcacheKeys())
+		if err == nil {
+			t.unlockMemcache()
+		}
+	}
+	return commit, err
+}
+
+// lockMemcache sets the lock items of every entity written in the
+// transaction and drops their local copies. The caller must hold t's lock.
+func (t *Transaction) lockMemcache() error {
+	if err := t.client.lockCache(t.ctx, t.lockMemcacheItems,
+		t.keys); err != nil {
+		return err
+	}
+	t.client.localCache.delete(t.lockMemcacheKeys())
+	return nil
+}
+
+// unlockMemcache removes the lock items once the transaction has committed,
+// as putMulti does outside transactions. If the commit failed the locks are
+// left to expire instead. It also invalidates cached queries of the kinds
+// written.
+func (t *Transaction) unlockMemcache() {
+	if err := t.client.memcacheDeleteMulti(t.ctx,
+		t.lockMemcacheKeys()); err != nil {
+		t.client.warn(t.ctx, "Transaction", "cache DeleteMulti failed", err,
+			"keys", len(t.lockMemcacheItems))
+	}
+	t.client.invalidateQueries(t.ctx, t.keys)
+}
+
+func (t *Transaction) lockMemcacheKeys() []string {
+	lockMemcacheKeys := make([]string, len(t.lockMemcacheItems))
+	for i, item := range t.lockMemcacheItems {
+		lockMemcacheKeys[i] = item.Key
+	}
+	return lockMemcacheKeys
+}
 
 // Commit applies the enqueued operations atomically.
-func (t *transaction) Commit() (*datastore.Commit, error) {
+func (t *Transaction) Commit() (*datastore.Commit, error) {
 	t.Lock()
 	defer t.Unlock()
-	memcacheSetMulti(nil, t.lockMemcacheItems)
-	return t.tx.Commit()
+
+	// Make sure we can lock memcache with no errors before committing.
+	if err := t.lockMemcache(); err != nil {
+		return nil, err
+	}
+	defer func() {
+		t.client.localCache.delete(t.lockMemcacheKeys())
+		t.client.flights.forget(t.lockMemcacheKeys())
+	}()
+
+	commit, err := t.tx.Commit()
+	if err == nil {
+		t.unlockMemcache()
+	}
+	return commit, err
 }
 
 // Rollback abandons a pending transaction.
-func (t *transaction) Rollback() error {
+func (t *Transaction) Rollback() error {
 	return t.tx.Rollback()
 }
 
@@ -104,13 +179,14 @@ func (t *transaction) Rollback() error {
 // snapshot. Furthermore, if the transaction is set to a serializable isolation
 // level, another transaction cannot concurrently modify the data that is read
 // or modified by this transaction.
-func (t *transaction) Get(key *datastore.Key, dst interface{}) error {
-	return Get(nil, key, dst)
+func (t *Transaction) Get(key *datastore.Key, dst interface{}) error {
+	return t.client.Get(t.ctx, key, dst)
 }
 
-// GetMulti is a batch version of Get.
-func (t *transaction) GetMulti(keys []*datastore.Key, dst interface{}) error {
-	return GetMulti(nil, keys, dst)
+// GetMulti is a batch version of Get. Like the package function GetMulti it
+// is not limited to 1000 keys per call.
+func (t *Transaction) GetMulti(keys []*datastore.Key, dst interface{}) error {
+	return t.client.GetMulti(t.ctx, keys, dst)
 }
 
 // Put is the transaction-specific version of the package function Put.
@@ -119,9 +195,9 @@ func (t *transaction) GetMulti(keys []*datastore.Key, dst interface{}) error {
 // return value from a successful Commit. If key is an incomplete key, the
 // returned pending key will resolve to a unique key generated by the
 // datastore.
-func (t *transaction) Put(key *datastore.Key, src interface{}) (*datastore.PendingKey, error) {
+func (t *Transaction) Put(key *datastore.Key, src interface{}) (*datastore.PendingKey, error) {
 	keys := []*datastore.Key{key}
-	pendingKeys, err := t.tx.PutMulti(keys, src)
+	pendingKeys, err := t.PutMulti(keys, []interface{}{src})
 	if err != nil {
 		if me, ok := err.(datastore.MultiError); ok {
 			return nil, me[0]
@@ -133,13 +209,13 @@ func (t *transaction) Put(key *datastore.Key, src interface{}) (*datastore.Pendi
 
 // PutMulti is a batch version of Put. One PendingKey is returned for each
 // element of src in the same order.
-func (t *transaction) PutMulti(keys []*datastore.Key, src interface{}) ([]*datastore.PendingKey, error) {
+func (t *Transaction) PutMulti(keys []*datastore.Key, src interface{}) ([]*datastore.PendingKey, error) {
 
 	lockMemcacheKeys := make([]string, 0, len(keys))
-	lockMemcacheItems := make([]*memcache.Item, 0, len(keys))
+	lockMemcacheItems := make([]*Item, 0, len(keys))
 	for _, key := range keys {
-		if !key.Incomplete() {
-			item := &memcache.Item{
+		if !key.Incomplete() && !t.client.writePolicy(key.Kind).NoCache {
+			item := &Item{
 				Key:        createMemcacheKey(key),
 				Flags:      lockItem,
 				Value:      itemLock(),
@@ -152,6 +228,7 @@ func (t *transaction) PutMulti(keys []*datastore.Key, src interface{}) ([]*datas
 	t.Lock()
 	t.lockMemcacheItems = append(t.lockMemcacheItems,
 		lockMemcacheItems...)
+	t.keys = append(t.keys, keys...)
 	t.Unlock()
 	return t.tx.PutMulti(keys, src)
 }
@@ -159,8 +236,8 @@ func (t *transaction) PutMulti(keys []*datastore.Key, src interface{}) ([]*datas
 // Delete is the transaction-specific version of the package function Delete.
 // Delete enqueues the deletion of the entity for the given key, to be
 // committed atomically upon calling Commit.
-func (t *transaction) Delete(key *datastore.Key) error {
-	err := t.tx.DeleteMulti([]*datastore.Key{key})
+func (t *Transaction) Delete(key *datastore.Key) error {
+	err := t.DeleteMulti([]*datastore.Key{key})
 	if me, ok := err.(datastore.MultiError); ok {
 		return me[0]
 	}
@@ -168,15 +245,16 @@ func (t *transaction) Delete(key *datastore.Key) error {
 }
 
 // DeleteMulti is a batch version of Delete.
-func (t *transaction) DeleteMulti(keys []*datastore.Key) error {
-	lockMemcacheItems := []*memcache.Item{}
+func (t *Transaction) DeleteMulti(keys []*datastore.Key) error {
+	lockMemcacheItems := []*Item{}
 	for _, key := range keys {
 		// Worst case scenario is that we lock the entity for memcacheLockTime.
 		// datastore.Delete will raise the appropriate error.
-		if key == nil || key.Incomplete() {
+		if key == nil || key.Incomplete() ||
+			t.client.writePolicy(key.Kind).NoCache {
 			continue
 		}
-		item := &memcache.Item{
+		item := &Item{
 			Key:        createMemcacheKey(key),
 			Flags:      lockItem,
 			Value:      itemLock(),
@@ -187,6 +265,7 @@ func (t *transaction) DeleteMulti(keys []*datastore.Key) error {
 	t.Lock()
 	t.lockMemcacheItems = append(t.lockMemcacheItems,
 		lockMemcacheItems...)
+	t.keys = append(t.keys, keys...)
 	t.Unlock()
 	return t.tx.DeleteMulti(keys)
 }
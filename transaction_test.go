@@ -1,99 +1,262 @@
 package nds_test
 
-//import (
-//	//"errors"
-//	"testing"
-//
-//	"github.com/yoavfeld/nds"
-//	"golang.org/x/net/context"
-//	"cloud.google.com/go/datastore"
-//)
-//
-//// TestClearNamespacedLocks tests to make sure that locks are cleared when
-//// RunInTransaction is using a namespace.
-//func TestClearNamespacedLocks(t *testing.T) {
-//	c, closeFunc := NewContext(t)
-//	defer closeFunc()
-//
-//	c, err := appengine.Namespace(c, "testnamespace")
-//	if err != nil {
-//		t.Fatal(err)
-//	}
-//
-//	type testEntity struct {
-//		Val int
-//	}
-//
-//	key := datastore.NewKey(c, "TestEntity", "", 1, nil)
-//
-//	// Prime cache.
-//	if err := nds.Get(c, key, &testEntity{}); err == nil {
-//		t.Fatal("expected no such entity")
-//	} else if err != datastore.ErrNoSuchEntity {
-//		t.Fatal(err)
-//	}
-//
-//	if err := nds.RunInTransaction(c, func(tc context.Context) error {
-//
-//		if err := nds.Get(tc, key, &testEntity{}); err == nil {
-//			return errors.New("expected no such entity")
-//		} else if err != datastore.ErrNoSuchEntity {
-//			return err
-//		}
-//
-//		if _, err := nds.Put(tc, key, &testEntity{3}); err != nil {
-//			return err
-//		}
-//		return nil
-//	}, nil); err != nil {
-//		t.Fatal(err)
-//	}
-//
-//	entity := &testEntity{}
-//	if err := nds.Get(c, key, entity); err != nil {
-//		t.Fatal(err)
-//	}
-//
-//	if entity.Val != 3 {
-//		t.Fatal("incorrect val")
-//	}
-//}
-//
-//func TestTransactionOptions(t *testing.T) {
-//	c, closeFunc := NewContext(t)
-//	defer closeFunc()
-//
-//	type testEntity struct {
-//		Val int
-//	}
-//
-//	opts := &datastore.TransactionOption{XG: true}
-//	err := nds.RunInTransaction(c, func(tc context.Context) error {
-//		for i := 0; i < 4; i++ {
-//			key := datastore.NewIncompleteKey(tc, "Entity", nil)
-//			if _, err := nds.Put(tc, key, &testEntity{i}); err != nil {
-//				return err
-//			}
-//		}
-//		return nil
-//	}, opts)
-//
-//	if err != nil {
-//		t.Fatal(err)
-//	}
-//
-//	opt := datastore.MaxAttempts(5)
-//	err, _ := nds.RunInTransaction(c, func(tx *datastore.Transaction) error {
-//		for i := 0; i < 4; i++ {
-//			key := datastore.IncompleteKey( "Entity", nil)
-//			if _, err := nds.Put(c, key, &testEntity{i}); err != nil {
-//				return err
-//			}
-//			tx.Rollback()
-//		}
-//		return nil
-//	}, opt)
-//	if err == nil {
-//		t.Fatal("expected cross-group error")
-//	}
-//}
+import (
+	"errors"
+	"testing"
+
+	"github.com/yoavfeld/nds"
+
+	"cloud.google.com/go/datastore"
+	"golang.org/x/net/context"
+)
+
+// TestRunInTransactionClearsCache tests to make sure that entities written in
+// RunInTransaction are not served stale from the cache.
+func TestRunInTransactionClearsCache(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	key := datastore.IDKey("TestEntity", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Prime cache.
+	if err := nds.Get(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := nds.RunInTransaction(c, func(tx *nds.Transaction) error {
+		if _, err := tx.Put(key, &testEntity{3}); err != nil {
+			return err
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	entity := &testEntity{}
+	if err := nds.Get(c, key, entity); err != nil {
+		t.Fatal(err)
+	}
+
+	if entity.Val != 3 {
+		t.Fatal("incorrect val")
+	}
+}
+
+func TestRunInTransactionError(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	key := datastore.IDKey("TestEntity", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedErr := errors.New("expected error")
+	_, err := nds.RunInTransaction(c, func(tx *nds.Transaction) error {
+		if _, err := tx.Put(key, &testEntity{3}); err != nil {
+			return err
+		}
+		return expectedErr
+	}, datastore.MaxAttempts(1))
+	if err != expectedErr {
+		t.Fatal("expected expectedErr", err)
+	}
+
+	entity := &testEntity{}
+	if err := nds.Get(c, key, entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.Val != 2 {
+		t.Fatal("expected rolled back val", entity.Val)
+	}
+}
+
+func TestRunInTransactionLockFailure(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+	if err := nds.InitNDS(c, memcacheAddr, projectID); err != nil {
+		t.Fatal(err)
+	}
+
+	type testEntity struct {
+		Val int
+	}
+
+	key := datastore.IDKey("TestEntity", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+
+	nds.SetMemcacheSetMulti(func(c context.Context, items []*nds.Item) error {
+		return errors.New("expected error")
+	})
+	defer nds.SetMemcacheSetMulti(nds.McClient().SetMulti)
+
+	if _, err := nds.RunInTransaction(c, func(tx *nds.Transaction) error {
+		_, err := tx.Put(key, &testEntity{3})
+		return err
+	}); err == nil {
+		t.Fatal("expected lock error")
+	}
+
+	entity := &testEntity{}
+	if err := nds.Get(c, key, entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.Val != 2 {
+		t.Fatal("expected uncommitted val", entity.Val)
+	}
+}
+
+func TestNewTransactionCommit(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	key := datastore.IDKey("TestEntity", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Prime cache.
+	if err := nds.Get(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := nds.NewTransaction(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := nds.Get(c, key, &testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity", err)
+	}
+}
+
+func TestRunInTransactionReleasesLocks(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	keys := []*datastore.Key{
+		datastore.IDKey("TestEntity", 1, nil),
+		datastore.IDKey("TestEntity", 2, nil),
+	}
+	if _, err := nds.RunInTransaction(c, func(tx *nds.Transaction) error {
+		if _, err := tx.PutMulti(keys,
+			[]testEntity{{1}, {2}}); err != nil {
+			return err
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	memcacheKeys := []string{
+		nds.CreateMemcacheKey(keys[0]),
+		nds.CreateMemcacheKey(keys[1]),
+	}
+	items, err := nds.McClient().GetMulti(c, memcacheKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range items {
+		if item.Flags == nds.LockItem {
+			t.Fatal("expected lock to be released", item.Key)
+		}
+	}
+
+	// The entities can be cached straight away.
+	if err := nds.GetMulti(c, keys, make([]testEntity, 2)); err != nil {
+		t.Fatal(err)
+	}
+	items, err = nds.McClient().GetMulti(c, memcacheKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, memcacheKey := range memcacheKeys {
+		if item, ok := items[memcacheKey]; !ok {
+			t.Fatal("expected cached entity")
+		} else if item.Flags != nds.EntityItem {
+			t.Fatal("expected entity item", item.Flags)
+		}
+	}
+}
+
+func TestTransactionGetMulti(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+	if err := nds.InitNDS(c, memcacheAddr, projectID); err != nil {
+		t.Fatal(err)
+	}
+
+	type testEntity struct {
+		Val int
+	}
+
+	defer nds.SetMemcacheGetMulti(nds.McClient().GetMulti)
+
+	for _, count := range []int{999, 1000, 1001} {
+		keys := make([]*datastore.Key, count)
+		entities := make([]testEntity, count)
+		for i := range keys {
+			keys[i] = datastore.IDKey("TestEntity", int64(i+1), nil)
+			entities[i] = testEntity{i}
+		}
+		if _, err := nds.PutMulti(c, keys, entities); err != nil {
+			t.Fatal(err)
+		}
+
+		// Reads inside a transaction must not touch the cache.
+		nds.SetMemcacheGetMulti(func(c context.Context,
+			keys []string) (map[string]*nds.Item, error) {
+			return nil, errors.New("unexpected cache read")
+		})
+
+		if _, err := nds.RunInTransaction(c, func(tx *nds.Transaction) error {
+			got := make([]testEntity, count)
+			if err := tx.GetMulti(keys, got); err != nil {
+				return err
+			}
+			for i, entity := range got {
+				if entity.Val != i {
+					return errors.New("incorrect val")
+				}
+			}
+
+			entity := &testEntity{}
+			if err := tx.Get(keys[count-1], entity); err != nil {
+				return err
+			}
+			if entity.Val != count-1 {
+				return errors.New("incorrect val")
+			}
+			return nil
+		}, datastore.ReadOnly); err != nil {
+			t.Fatal(err)
+		}
+	}
+}